@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// binfmtDir is where the binfmt_misc handlers are listed, including the qemu-user ones running foreign binaries.
+const binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// qemuArchitectures maps the GOARCH values to the names of their qemu-user binfmt_misc handlers (qemu-<name>).
+var qemuArchitectures = map[string]string{
+	"amd64":   "x86_64",
+	"arm64":   "aarch64",
+	"arm":     "arm",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+	"riscv64": "riscv64",
+}
+
+// detectHostArchitecture returns the architecture of the machine, as a GOARCH value
+// (https://go.dev/doc/install/source#environment).
+// It differs from runtime.GOARCH if the step runs translated (Rosetta) or emulated (qemu-user).
+func detectHostArchitecture() string {
+	arch := runtime.GOARCH
+	switch runtime.GOOS {
+	case "darwin":
+		// only Apple silicon translates processes
+		if commandOutput("sysctl", "-n", "sysctl.proc_translated") == "1" {
+			log.Printf("The step runs translated by Rosetta")
+			arch = "arm64"
+		}
+	case "linux":
+		// uname reports the emulated architecture if it is run by qemu-user too, e.g. in a foreign architecture container
+		if machine := normalizeArchitecture(commandOutput("uname", "-m")); machine != "" {
+			arch = machine
+		}
+		if host, emulated := qemuHostArchitecture(binfmtDir, arch); emulated {
+			log.Printf("The step runs emulated by qemu-user")
+			if host == "" {
+				log.Warnf("Failed to detect the host architecture of the emulated %s", arch)
+			} else {
+				arch = host
+			}
+		}
+	}
+
+	if arch != runtime.GOARCH {
+		log.Warnf("The step binary is %s, running on a %s host", runtime.GOARCH, arch)
+	}
+	return arch
+}
+
+// qemuHostArchitecture reports whether arch is run by a qemu-user binfmt_misc handler, and if so, returns the host's architecture.
+// binfmt_misc is shared with the host, which has handlers registered for the foreign architectures only,
+// so the host is the 64-bit architecture without a handler.
+func qemuHostArchitecture(dir, arch string) (string, bool) {
+	name, ok := qemuArchitectures[arch]
+	if !ok || !binfmtEnabled(filepath.Join(dir, "qemu-"+name)) {
+		return "", false
+	}
+
+	var hosts []string
+	for _, host := range []string{"amd64", "arm64"} {
+		if host != arch && !binfmtEnabled(filepath.Join(dir, "qemu-"+qemuArchitectures[host])) {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) != 1 {
+		return "", true
+	}
+	return hosts[0], true
+}
+
+// binfmtEnabled reports whether the binfmt_misc handler at pth is registered and enabled.
+func binfmtEnabled(pth string) bool {
+	b, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(string(b), "enabled")
+}
+
+// normalizeArchitecture converts a uname machine name to a GOARCH value.
+func normalizeArchitecture(machine string) string {
+	switch machine = strings.TrimSpace(machine); machine {
+	case "x86_64", "amd64":
+		return "amd64"
+	case "aarch64", "arm64":
+		return "arm64"
+	case "i386", "i486", "i586", "i686":
+		return "386"
+	case "ppc64le", "s390x", "riscv64":
+		return machine
+	}
+	if strings.HasPrefix(machine, "armv") {
+		return "arm"
+	}
+	return ""
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func Test_normalizeArchitecture(t *testing.T) {
+	for machine, want := range map[string]string{"x86_64": "amd64", "aarch64": "arm64", "armv7l": "arm", "i686": "386", "sparc": ""} {
+		if got := normalizeArchitecture(machine); got != want {
+			t.Errorf("normalizeArchitecture(%s) = %s, want %s", machine, got, want)
+		}
+	}
+}
+
+func Test_qemuHostArchitecture(t *testing.T) {
+	tests := []struct {
+		name         string
+		handlers     map[string]string
+		arch         string
+		wantHost     string
+		wantEmulated bool
+	}{
+		{name: "native", handlers: map[string]string{"qemu-aarch64": "enabled\n"}, arch: "amd64"},
+		{name: "no binfmt_misc", arch: "amd64"},
+		{
+			name:         "emulated amd64 on arm64",
+			handlers:     map[string]string{"qemu-x86_64": "enabled\ninterpreter /usr/bin/qemu-x86_64-static\n", "qemu-arm": "enabled\n"},
+			arch:         "amd64",
+			wantHost:     "arm64",
+			wantEmulated: true,
+		},
+		{name: "disabled handler", handlers: map[string]string{"qemu-x86_64": "disabled\n"}, arch: "amd64"},
+		{
+			name:         "unknown host",
+			handlers:     map[string]string{"qemu-x86_64": "enabled\n", "qemu-aarch64": "enabled\n"},
+			arch:         "amd64",
+			wantEmulated: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.handlers {
+				if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+					t.Fatalf("failed to write handler: %s", err)
+				}
+			}
+
+			host, emulated := qemuHostArchitecture(dir, tt.arch)
+			if host != tt.wantHost || emulated != tt.wantEmulated {
+				t.Errorf("qemuHostArchitecture() = %s, %v, want %s, %v", host, emulated, tt.wantHost, tt.wantEmulated)
+			}
+		})
+	}
+}
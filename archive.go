@@ -5,15 +5,41 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/bitrise-io/go-utils/command"
 	"github.com/bitrise-io/go-utils/errorutil"
 	"github.com/bitrise-io/go-utils/log"
 )
 
-// uncompressArchive invokes tar tool against a local archive file.
-func uncompressArchive(pth string, relative, compressed bool) error {
-	cmd := command.New("tar", processArgs(relative, compressed), pth)
+// uncompressArchive extracts a local archive file, decrypting it if it is encrypted.
+func uncompressArchive(pth string, key []byte, e *extractor) error {
+	f, err := os.Open(pth)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %s", pth, err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	r, _, err := openEnvelope(f, key)
+	if err != nil {
+		return err
+	}
+
+	log.Donef("Extracting %s", pth)
+
+	return e.extract(r)
+}
+
+// uncompressArchiveWithTar invokes tar tool against a local archive file.
+func uncompressArchiveWithTar(pth string, args []string) error {
+	cmd := command.New("tar", append(args, pth)...)
 
 	log.Donef(cmd.PrintableCommandArgs())
 
@@ -28,35 +54,58 @@ func uncompressArchive(pth string, relative, compressed bool) error {
 	return nil
 }
 
-// extractCacheArchive invokes tar tool by piping the archive to the command's input.
-func extractCacheArchive(r io.Reader, relative, compressed bool) error {
-	cmd := command.New("tar", processArgs(relative, compressed), "-")
-	cmd.SetStdin(r)
-
-	printableCmd := fmt.Sprintf("curl <CACHE_URL> | %s", cmd.PrintableCommandArgs())
-	log.Donef(printableCmd)
+// tarArgs returns the tar tool arguments extracting an archive with the extractor's options.
+// It returns false if an option can only be enforced by the native extractor
+// (filters, allowed paths, limits, staging, rollback and whiteouts) or is not supported by the installed tar.
+// Denied paths are excluded by name, the targets of the archive's links are not checked.
+func (e *extractor) tarArgs(gnu bool) ([]string, bool) {
+	o := e.opts
+	if len(o.Include) > 0 || len(o.Portable) > 0 || len(o.Exclude) > 0 || len(o.Paths.Allow) > 0 ||
+		o.Limits != (extractLimits{}) || o.Staged || o.Whiteouts || e.journal != nil {
+		return nil, false
+	}
 
-	if out, err := cmd.RunAndReturnTrimmedCombinedOutput(); err != nil {
-		errMsg := err.Error()
-		if errorutil.IsExitStatusError(err) {
-			errMsg = out
+	var args []string
+	switch o.OnConflict {
+	case conflictSkipExisting:
+		if gnu {
+			args = append(args, "--skip-old-files")
+		} else {
+			args = append(args, "-k")
 		}
-		return fmt.Errorf("%s failed: %s", printableCmd, errMsg)
+	case conflictKeepNewer:
+		args = append(args, "--keep-newer-files")
+	case conflictFail:
+		// BSD tar -k skips the existing files without failing
+		if !gnu {
+			return nil, false
+		}
+		args = append(args, "--keep-old-files")
 	}
 
-	if rc, ok := r.(io.ReadCloser); ok {
-		return rc.Close()
+	for _, deny := range o.Paths.Deny {
+		if o.Relative {
+			// the member names are relative to the working directory
+			wd, err := os.Getwd()
+			if err != nil {
+				return nil, false
+			}
+			rel, err := filepath.Rel(wd, deny)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				continue
+			}
+			deny = rel
+		}
+		args = append(args, "--exclude", deny)
 	}
-	return nil
+	// the archive path has to follow -f
+	return append(args, processArgs(o.Relative, o.Compressed)), true
 }
 
 func processArgs(relative, compressed bool) string {
 	/*
 		GNU  tar options
 
-		-f "-" : reads the archive from standard input
-		https://www.gnu.org/software/tar/manual/html_node/Device.html#SEC155
-
 		-x : extract files from an archive
 		https://www.gnu.org/software/tar/manual/html_node/extract.html#SEC25
 
@@ -84,6 +133,62 @@ func processArgs(relative, compressed bool) string {
 	return args
 }
 
+// isGNUTar reports whether the installed tar tool is GNU tar.
+func isGNUTar() bool {
+	out, err := command.New("tar", "--version").RunAndReturnTrimmedCombinedOutput()
+	return err == nil && strings.Contains(out, "GNU tar")
+}
+
+// extractCacheArchive extracts the archive streamed by the given reader.
+func extractCacheArchive(r io.Reader, e *extractor) error {
+	if err := e.extract(r); err != nil {
+		return err
+	}
+
+	if rc, ok := r.(io.ReadCloser); ok {
+		return rc.Close()
+	}
+	return nil
+}
+
+// walkArchive reads the archive streamed by r and calls fn for each entry, with the reader of the entry's content.
+func walkArchive(r io.Reader, compressed bool, fn func(io.Reader, *tar.Header) error) error {
+	archive := r
+	if compressed {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("failed to open gzip stream: %s", err)
+		}
+		defer func() {
+			if err := gr.Close(); err != nil {
+				log.Warnf("Failed to close gzip stream: %s", err)
+			}
+		}()
+		archive = gr
+	}
+
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive entry: %s", err)
+		}
+
+		if err := fn(tr, hdr); err != nil {
+			return err
+		}
+	}
+
+	// drain the tar padding (and verify the gzip checksum) so the whole archive is consumed
+	if _, err := io.Copy(ioutil.Discard, archive); err != nil {
+		return fmt.Errorf("failed to read archive trailer: %s", err)
+	}
+	return nil
+}
+
 // readFirstEntry reads the first entry from a given archive.
 func readFirstEntry(r io.Reader) (*tar.Reader, *tar.Header, bool, error) {
 	restoreReader := NewRestoreReader(r)
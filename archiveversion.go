@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/steps-cache-push/model"
+)
+
+// maxCompatibleArchiveVersion is the newest archive info version this step understands, the one of the cache push model.
+// Newer archives can be restored if they declare it with min_reader_version and required_features.
+const maxCompatibleArchiveVersion = model.Version
+
+// supportedArchiveFeatures are the archive features this step understands, an archive can require any of them.
+var supportedArchiveFeatures = map[string]bool{
+	"manifest":       true,
+	"whiteouts":      true,
+	"encryption":     true,
+	"signature":      true,
+	"index":          true,
+	"sparse":         true,
+	"sizes":          true,
+	"toolchain":      true,
+	"portable_paths": true,
+}
+
+// archiveVersionInfo is the version information of the archive info.
+type archiveVersionInfo struct {
+	Version uint64 `json:"version,omitempty"`
+	// MinReaderVersion is the oldest archive info version a reader has to understand to restore the archive,
+	// set by newer cache push steps if the archive can be restored by older cache pull steps.
+	MinReaderVersion uint64 `json:"min_reader_version,omitempty"`
+	// RequiredFeatures are the features a reader has to understand to restore the archive correctly.
+	RequiredFeatures []string `json:"required_features,omitempty"`
+}
+
+// checkArchiveVersion returns an error if the archive info is of a newer version or requires features this step does not understand.
+func checkArchiveVersion(archiveInfo []byte) error {
+	if archiveInfo == nil {
+		return nil
+	}
+
+	var info archiveVersionInfo
+	if err := json.Unmarshal(archiveInfo, &info); err != nil {
+		log.Debugf("Failed to parse archive version info: %s", err)
+		return nil
+	}
+
+	if info.Version > maxCompatibleArchiveVersion {
+		if info.MinReaderVersion == 0 || info.MinReaderVersion > maxCompatibleArchiveVersion {
+			return fmt.Errorf("the archive info version (%d) is newer than the supported version (%d)", info.Version, maxCompatibleArchiveVersion)
+		}
+		log.Printf("Archive info version %d is compatible with version %d", info.Version, info.MinReaderVersion)
+	}
+
+	var unsupported []string
+	for _, feature := range info.RequiredFeatures {
+		if !supportedArchiveFeatures[feature] {
+			unsupported = append(unsupported, feature)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("the archive requires unsupported features: %s", strings.Join(unsupported, ", "))
+	}
+	return nil
+}
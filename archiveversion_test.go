@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func Test_checkArchiveVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		archiveInfo string
+		wantErr     bool
+	}{
+		{name: "no archive info"},
+		{name: "older version", archiveInfo: `{"version": 1, "stack_id": "linux"}`},
+		{name: "current version", archiveInfo: `{"version": 2, "required_features": ["whiteouts", "sizes"]}`},
+		{name: "newer version", archiveInfo: `{"version": 3}`, wantErr: true},
+		{name: "newer compatible version", archiveInfo: `{"version": 3, "min_reader_version": 2, "required_features": ["sizes", "toolchain"]}`},
+		{name: "newer incompatible version", archiveInfo: `{"version": 4, "min_reader_version": 3}`, wantErr: true},
+		{name: "unsupported feature", archiveInfo: `{"version": 2, "required_features": ["whiteouts", "zstd"]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var archiveInfo []byte
+			if tt.archiveInfo != "" {
+				archiveInfo = []byte(tt.archiveInfo)
+			}
+			if err := checkArchiveVersion(archiveInfo); (err != nil) != tt.wantErr {
+				t.Errorf("checkArchiveVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// xattrPrefix is the prefix of the PAX records holding extended attributes, as written by GNU and BSD tar.
+const xattrPrefix = "SCHILY.xattr."
+
+// restoreOwner tells whether the restored files get the owner stored in the archive, like tar does when run by root.
+var restoreOwner = os.Geteuid() == 0
+
+// setOwnerAndXattrs applies the entry's owner (when running as root) and extended attributes to target.
+// Symlinks only get their owner. An extended attribute the file system does not support is skipped.
+func setOwnerAndXattrs(target string, hdr *tar.Header) error {
+	if restoreOwner {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, xattrPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(key, xattrPrefix)
+		if err := setXattr(target, name, []byte(value)); err != nil {
+			log.Debugf("Failed to set extended attribute %s of %s: %s", name, target, err)
+		}
+	}
+	return nil
+}
+
+// isSpecialEntry reports whether the entry is a fifo or a device node.
+func isSpecialEntry(hdr *tar.Header) bool {
+	switch hdr.Typeflag {
+	case tar.TypeFifo, tar.TypeChar, tar.TypeBlock:
+		return true
+	}
+	return false
+}
+
+// writeSpecial creates a fifo or a device node. Like with tar, creating a device node needs root.
+func writeSpecial(target string, hdr *tar.Header) error {
+	if err := prepareTarget(target); err != nil {
+		return err
+	}
+
+	perm := hdr.FileInfo().Mode().Perm()
+	var err error
+	switch hdr.Typeflag {
+	case tar.TypeFifo:
+		err = syscall.Mkfifo(target, uint32(perm))
+	case tar.TypeChar:
+		err = syscall.Mknod(target, syscall.S_IFCHR|uint32(perm), deviceNumber(hdr.Devmajor, hdr.Devminor))
+	case tar.TypeBlock:
+		err = syscall.Mknod(target, syscall.S_IFBLK|uint32(perm), deviceNumber(hdr.Devmajor, hdr.Devminor))
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := setOwnerAndXattrs(target, hdr); err != nil {
+		return err
+	}
+	if err := os.Chmod(target, perm); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
@@ -0,0 +1,14 @@
+package main
+
+import "errors"
+
+// deviceNumber encodes a device's major and minor numbers the way the Darwin kernel does.
+func deviceNumber(major, minor int64) int {
+	return int(major<<24 | minor)
+}
+
+// setXattr is not implemented on macOS: archives created there keep their extended attributes
+// in AppleDouble entries, which are restored as regular files.
+func setXattr(pth, name string, value []byte) error {
+	return errors.New("extended attributes are only restored on Linux")
+}
@@ -0,0 +1,12 @@
+package main
+
+import "syscall"
+
+// deviceNumber encodes a device's major and minor numbers the way the Linux kernel does.
+func deviceNumber(major, minor int64) int {
+	return int((minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32))
+}
+
+func setXattr(pth, name string, value []byte) error {
+	return syscall.Setxattr(pth, name, value, 0)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestExtractor_xattrs(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file.txt")
+	archive := createTestArchive(t, []testEntry{{name: file, content: "content", xattrs: map[string]string{"user.cache": "value"}}})
+
+	e := newExtractor(extractOptions{}, &restoreReport{})
+	if err := e.extract(archive); err != nil {
+		t.Fatalf("extract() error = %v", err)
+	}
+
+	value := make([]byte, 64)
+	n, err := syscall.Getxattr(file, "user.cache", value)
+	if err != nil {
+		t.Skipf("extended attributes are not supported here: %s", err)
+	}
+	if got := string(value[:n]); got != "value" {
+		t.Errorf("user.cache xattr = %s, want value", got)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	// branchPlaceholder is replaced by the branch name in the branch cache URL template.
+	branchPlaceholder = "{branch}"
+	// cacheBranchEnvKey is the step output holding the branch whose cache was restored.
+	cacheBranchEnvKey = "BITRISE_CACHE_BRANCH"
+)
+
+// cacheBranch is a branch whose cache can be restored, with the Cache API URL of the branch.
+type cacheBranch struct {
+	Name string
+	URL  string
+}
+
+// fallbackBranches returns the branches whose cache is tried, in order, if the current branch has no cache:
+// the pull request's target branch, then the default branch.
+func fallbackBranches(conf Config) []cacheBranch {
+	var branches []cacheBranch
+	seen := map[string]bool{conf.Branch: true}
+	for _, name := range []string{conf.PRTargetBranch, conf.DefaultBranch} {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		branchURL := branchCacheURL(conf, name)
+		if branchURL == "" {
+			log.Debugf("The Cache API URL of the %s branch is unknown, specify the branch cache URL template", name)
+			continue
+		}
+		branches = append(branches, cacheBranch{Name: name, URL: branchURL})
+	}
+	return branches
+}
+
+// branchCacheURL returns the Cache API URL of the branch from the branch cache URL template,
+// or "" if the template is not specified.
+func branchCacheURL(conf Config, branch string) string {
+	if conf.BranchCacheURL == "" {
+		return ""
+	}
+	return strings.Replace(conf.BranchCacheURL, branchPlaceholder, url.PathEscape(branch), -1)
+}
+
+// resolveBranchCache gets the cache download URL of the current branch, or if it has no cache, of the first fallback branch which has.
+// It returns false if none of the branches have a cache.
+func (p puller) resolveBranchCache(src cacheSource) (string, bool, error) {
+	branches := append([]cacheBranch{{Name: p.conf.Branch, URL: src.URL}}, src.Branches...)
+	for i, branch := range branches {
+		downloadURL, err := getCacheDownloadURL(branch.URL)
+		if errors.Is(err, errNoCache) {
+			if i < len(branches)-1 {
+				log.Printf("No saved cache found for the %s branch, trying the %s branch", branchName(branch.Name), branchName(branches[i+1].Name))
+			}
+			continue
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("failed to get cache download URL: %s", err)
+		}
+
+		if i > 0 {
+			log.Warnf("Using the cache of the %s branch", branch.Name)
+		}
+		p.report.Branch = branch.Name
+		return downloadURL, true, nil
+	}
+	return "", false, nil
+}
+
+func branchName(name string) string {
+	if name == "" {
+		return "current"
+	}
+	return name
+}
+
+// setCacheBranch records the branch whose cache was restored as a step output.
+func (o *stepOutputs) setCacheBranch(branch, name string) {
+	o.set(outputKey(cacheBranchEnvKey, name), branch)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func Test_fallbackBranches(t *testing.T) {
+	tests := []struct {
+		name string
+		conf Config
+		want []cacheBranch
+	}{
+		{
+			name: "pull request",
+			conf: Config{CacheAPIURL: "https://cache.example.com/feature/cache", BranchCacheURL: "https://cache.example.com/{branch}/cache", Branch: "feature", PRTargetBranch: "develop", DefaultBranch: "main"},
+			want: []cacheBranch{
+				{Name: "develop", URL: "https://cache.example.com/develop/cache"},
+				{Name: "main", URL: "https://cache.example.com/main/cache"},
+			},
+		},
+		{
+			name: "URL template",
+			conf: Config{CacheAPIURL: "https://cache.example.com/feature/cache", BranchCacheURL: "https://cache.example.com/{branch}/cache", Branch: "feature", PRTargetBranch: "release/1.0", DefaultBranch: "release/1.0"},
+			want: []cacheBranch{{Name: "release/1.0", URL: "https://cache.example.com/release%2F1.0/cache"}},
+		},
+		{
+			name: "current branch only",
+			conf: Config{CacheAPIURL: "https://cache.example.com/cache", Branch: "main", DefaultBranch: "main"},
+		},
+		{
+			name: "no URL template",
+			conf: Config{CacheAPIURL: "https://cache.example.com/cache?branch=feature", Branch: "feature", PRTargetBranch: "develop", DefaultBranch: "main"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fallbackBranches(tt.conf); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fallbackBranches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPuller_resolveBranchCache(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/main/cache":
+			fmt.Fprint(w, `{"download_url": "https://storage.example.com/main.tar"}`)
+		case "/broken/cache":
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	branchURL := func(branch string) string { return server.URL + "/" + branch + "/cache" }
+	tests := []struct {
+		name       string
+		branches   []string
+		want       string
+		wantOK     bool
+		wantBranch string
+		wantErr    bool
+	}{
+		{name: "current branch", branches: []string{"main"}, want: "https://storage.example.com/main.tar", wantOK: true},
+		{name: "fallback branch", branches: []string{"feature", "develop", "main"}, want: "https://storage.example.com/main.tar", wantOK: true, wantBranch: "main"},
+		{name: "no cache", branches: []string{"feature", "develop"}},
+		{name: "failing branch", branches: []string{"feature", "broken", "main"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := cacheSource{URL: branchURL(tt.branches[0])}
+			for _, name := range tt.branches[1:] {
+				src.Branches = append(src.Branches, cacheBranch{Name: name, URL: branchURL(name)})
+			}
+			p := puller{report: &restoreReport{}}
+
+			got, ok, err := p.resolveBranchCache(src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveBranchCache() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("resolveBranchCache() = %s, %v, want %s, %v", got, ok, tt.want, tt.wantOK)
+			}
+			if p.report.Branch != tt.wantBranch {
+				t.Errorf("report.Branch = %s, want %s", p.report.Branch, tt.wantBranch)
+			}
+		})
+	}
+}
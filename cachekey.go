@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/retry"
+)
+
+const (
+	// cacheHitEnvKey is the step output telling whether the cache key matched exactly, partially or not at all.
+	cacheHitEnvKey = "BITRISE_CACHE_HIT"
+	// cacheMatchedKeyEnvKey is the step output holding the key of the restored cache entry.
+	cacheMatchedKeyEnvKey = "BITRISE_CACHE_MATCHED_KEY"
+)
+
+// cacheHit is the result of a key-based cache lookup.
+type cacheHit string
+
+const (
+	cacheHitExact   cacheHit = "exact"
+	cacheHitPartial cacheHit = "partial"
+	cacheMiss       cacheHit = "false"
+)
+
+// archiveSuffixes are the file name suffixes of the cache archives stored in a local cache backend.
+var archiveSuffixes = []string{".tar.gz", ".tgz", ".tar"}
+
+// cacheKeyData is the data available in the cache key templates.
+type cacheKeyData struct {
+	OS       string
+	Arch     string
+	Branch   string
+	Workflow string
+}
+
+// cacheEntry is a cache archive stored in the cache backend under a key.
+type cacheEntry struct {
+	Key         string `json:"key"`
+	DownloadURL string `json:"download_url"`
+	modTime     time.Time
+}
+
+// evaluateCacheKey evaluates a cache key template, e.g. npm-{{ .OS }}-{{ checksum "package-lock.json" }}.
+// The checksum function's paths are relative to workDir and can be glob patterns.
+func evaluateCacheKey(key string, data cacheKeyData, workDir string) (string, error) {
+	funcs := template.FuncMap{
+		"checksum": func(patterns ...string) (string, error) {
+			return checksumFiles(workDir, patterns)
+		},
+		"getenv": os.Getenv,
+	}
+
+	tmpl, err := template.New("cache_key").Funcs(funcs).Option("missingkey=error").Parse(key)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// checksumFiles returns the hex encoded SHA-256 checksum of the files matching the patterns, in path order.
+func checksumFiles(workDir string, patterns []string) (string, error) {
+	var paths []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(workDir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return "", err
+		}
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		return "", fmt.Errorf("no files match %s", strings.Join(patterns, ", "))
+	}
+	sort.Strings(paths)
+
+	h := sha256.New()
+	for _, pth := range paths {
+		if err := hashFile(h, pth); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// lookupCacheEntry finds the cache entry of the key, or if there is none, the newest entry
+// matching the first restore key prefix which has any. It returns nil if no entry matches.
+func lookupCacheEntry(backendURL, key string, restoreKeys []string) (*cacheEntry, error) {
+	if strings.HasPrefix(backendURL, "file://") {
+		return lookupLocalCacheEntry(strings.TrimPrefix(backendURL, "file://"), key, restoreKeys)
+	}
+	return lookupRemoteCacheEntry(backendURL, key, restoreKeys)
+}
+
+// lookupLocalCacheEntry looks up the cache entry in a directory holding the archives named after their keys, e.g. <key>.tar.gz.
+func lookupLocalCacheEntry(dir, key string, restoreKeys []string) (*cacheEntry, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []cacheEntry
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		for _, suffix := range archiveSuffixes {
+			if strings.HasSuffix(info.Name(), suffix) {
+				entries = append(entries, cacheEntry{
+					Key:         strings.TrimSuffix(info.Name(), suffix),
+					DownloadURL: "file://" + filepath.Join(dir, info.Name()),
+					modTime:     info.ModTime(),
+				})
+				break
+			}
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.Key == key {
+			return &entry, nil
+		}
+	}
+
+	// newest first
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].modTime.After(entries[j].modTime) })
+	for _, prefix := range restoreKeys {
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Key, prefix) {
+				return &entry, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// lookupRemoteCacheEntry asks the cache backend for the entry, passing the key and the restore keys in order:
+// GET <backend URL>?keys=<key>,<restore key>,... responds with {"key": "...", "download_url": "..."}, or 404 if no entry matches.
+func lookupRemoteCacheEntry(backendURL, key string, restoreKeys []string) (*cacheEntry, error) {
+	u, err := url.Parse(backendURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache backend URL: %s", err)
+	}
+	query := u.Query()
+	query.Set("keys", strings.Join(append([]string{key}, restoreKeys...), ","))
+	u.RawQuery = query.Encode()
+
+	c := retry.NewHTTPClient().StandardClient()
+	c.Timeout = 20 * time.Second
+	resp, err := c.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %s", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %s", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, body)
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON response (%s): %s", body, err)
+	}
+	if entry.DownloadURL == "" {
+		return nil, errors.New("download URL not included in the response")
+	}
+	return &entry, nil
+}
+
+// resolveCacheKey evaluates the cache key and the restore keys, and looks up the matching cache entry.
+func resolveCacheKey(conf Config, arch string) (*cacheEntry, cacheHit, error) {
+	data := cacheKeyData{OS: runtime.GOOS, Arch: arch, Branch: conf.Branch, Workflow: conf.Workflow}
+
+	key, err := evaluateCacheKey(conf.CacheKey, data, conf.WorkDir)
+	if err != nil {
+		return nil, cacheMiss, fmt.Errorf("invalid cache key: %s", err)
+	}
+
+	var restoreKeys []string
+	for _, line := range strings.Split(conf.RestoreKeys, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		restoreKey, err := evaluateCacheKey(line, data, conf.WorkDir)
+		if err != nil {
+			return nil, cacheMiss, fmt.Errorf("invalid restore key: %s", err)
+		}
+		restoreKeys = append(restoreKeys, restoreKey)
+	}
+
+	log.Printf("cache key: %s", key)
+	for _, restoreKey := range restoreKeys {
+		log.Printf("restore key: %s", restoreKey)
+	}
+
+	entry, err := lookupCacheEntry(conf.CacheBackendURL, key, restoreKeys)
+	if err != nil {
+		return nil, cacheMiss, fmt.Errorf("failed to look up the cache key: %s", err)
+	}
+	switch {
+	case entry == nil:
+		return nil, cacheMiss, nil
+	case entry.Key == key:
+		return entry, cacheHitExact, nil
+	default:
+		return entry, cacheHitPartial, nil
+	}
+}
+
+// setCacheHit records the result of the cache key lookup as step outputs.
+func (o *stepOutputs) setCacheHit(hit cacheHit, matchedKey, name string) {
+	o.set(outputKey(cacheHitEnvKey, name), string(hit))
+	o.set(outputKey(cacheMatchedKeyEnvKey, name), matchedKey)
+}
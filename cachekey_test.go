@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_evaluateCacheKey(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "package-lock.json"), []byte("{}"), 0644); err != nil {
+		t.Fatalf("failed to write lockfile: %s", err)
+	}
+	sum, err := checksumFiles(dir, []string{"package-lock.json"})
+	if err != nil {
+		t.Fatalf("checksumFiles() error = %v", err)
+	}
+
+	data := cacheKeyData{OS: "linux", Arch: "arm64", Branch: "main", Workflow: "primary"}
+	got, err := evaluateCacheKey(`npm-{{ .OS }}-{{ .Arch }}-{{ .Branch }}-{{ checksum "*.json" }}`, data, dir)
+	if err != nil {
+		t.Fatalf("evaluateCacheKey() error = %v", err)
+	}
+	if want := "npm-linux-arm64-main-" + sum; got != want {
+		t.Errorf("evaluateCacheKey() = %s, want %s", got, want)
+	}
+
+	for _, invalid := range []string{`{{ checksum "yarn.lock" }}`, `{{ .Unknown }}`, `{{ .OS`} {
+		if _, err := evaluateCacheKey(invalid, data, dir); err == nil {
+			t.Errorf("evaluateCacheKey(%s) expected error", invalid)
+		}
+	}
+}
+
+func Test_lookupLocalCacheEntry(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for name, age := range map[string]time.Duration{
+		"npm-linux-aaa.tar.gz":     3 * time.Hour,
+		"npm-linux-bbb.tar.gz":     time.Hour,
+		"npm-linux-bbb.tar.gz.sig": 0,
+		"npm-darwin-ccc.tar":       0,
+	} {
+		pth := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(pth, nil, 0644); err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+		if err := os.Chtimes(pth, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatalf("failed to set modification time: %s", err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		key         string
+		restoreKeys []string
+		want        string
+	}{
+		{name: "exact", key: "npm-linux-aaa", restoreKeys: []string{"npm-"}, want: "npm-linux-aaa"},
+		{name: "newest prefix match", key: "npm-linux-ddd", restoreKeys: []string{"npm-linux-"}, want: "npm-linux-bbb"},
+		{name: "restore keys in order", key: "npm-linux-ddd", restoreKeys: []string{"npm-windows-", "npm-darwin-", "npm-"}, want: "npm-darwin-ccc"},
+		{name: "miss", key: "gradle-linux-aaa", restoreKeys: []string{"gradle-"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := lookupCacheEntry("file://"+dir, tt.key, tt.restoreKeys)
+			if err != nil {
+				t.Fatalf("lookupCacheEntry() error = %v", err)
+			}
+
+			got := ""
+			if entry != nil {
+				got = entry.Key
+			}
+			if got != tt.want {
+				t.Errorf("lookupCacheEntry() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/docker/go-units"
+)
+
+// estimatedCompressionRatio is the assumed ratio of the uncompressed and compressed archive size,
+// used if the archive info does not contain the uncompressed size.
+const estimatedCompressionRatio = 3
+
+// archiveSizeInfo is the size information the cache push step can store in the archive info.
+type archiveSizeInfo struct {
+	// UncompressedSize is the total size of the archive's entries.
+	UncompressedSize int64 `json:"uncompressed_size,omitempty"`
+	// Sizes is the size of the entries under each cached path.
+	Sizes map[string]int64 `json:"sizes,omitempty"`
+}
+
+// filesystemUsage is the expected disk usage of a restored archive on a filesystem.
+type filesystemUsage struct {
+	path     string
+	device   uint64
+	required int64
+	free     int64
+	// reserved is the space required by the other caches being restored to the filesystem
+	reserved int64
+}
+
+func (u filesystemUsage) fits() bool {
+	return u.required+u.reserved <= u.free
+}
+
+// reservations is the disk space reserved per filesystem device by the caches being restored concurrently.
+// The free space is only checked before the extraction, so the caches restored at the same time could not fit together otherwise.
+var reservations = struct {
+	sync.Mutex
+	bytes map[uint64]int64
+}{bytes: map[uint64]int64{}}
+
+// reserveDiskSpace sets the space reserved by the other caches on the usages and, if all of them fit,
+// reserves their required space until the returned function is called.
+func reserveDiskSpace(usages []filesystemUsage) (func(), bool) {
+	reservations.Lock()
+	defer reservations.Unlock()
+
+	fits := true
+	for i := range usages {
+		usages[i].reserved = reservations.bytes[usages[i].device]
+		fits = fits && usages[i].fits()
+	}
+	if !fits {
+		return func() {}, false
+	}
+
+	for _, usage := range usages {
+		reservations.bytes[usage.device] += usage.required
+	}
+	return func() {
+		reservations.Lock()
+		defer reservations.Unlock()
+
+		for _, usage := range usages {
+			reservations.bytes[usage.device] -= usage.required
+		}
+	}, true
+}
+
+// expectedSizes returns the expected uncompressed size of the archive per cached path,
+// from the archive info if possible, otherwise estimated from the archive's length.
+// defaultPath is where the size is accounted if the archive info does not break it down per path.
+func expectedSizes(archiveInfo []byte, length int64, compressed bool, defaultPath string) (map[string]int64, bool) {
+	var info archiveSizeInfo
+	if archiveInfo != nil {
+		if err := json.Unmarshal(archiveInfo, &info); err != nil {
+			log.Debugf("Failed to parse archive size info: %s", err)
+		}
+	}
+
+	switch {
+	case len(info.Sizes) > 0:
+		return info.Sizes, true
+	case info.UncompressedSize > 0:
+		return map[string]int64{defaultPath: info.UncompressedSize}, true
+	case length >= 0:
+		if compressed {
+			length *= estimatedCompressionRatio
+		}
+		return map[string]int64{defaultPath: length}, true
+	default:
+		return nil, false
+	}
+}
+
+// diskSpaceError is returned when the files listed in the archive manifest would not fit on the disk.
+type diskSpaceError struct{}
+
+func (diskSpaceError) Error() string {
+	return "not enough free disk space to restore the cache archive"
+}
+
+// manifestSizes returns the space needed by the manifest's files per target directory.
+// If the replaced files are freed during the restore (no staging or rollback keeps them until its end),
+// the space of an existing file is subtracted from the size of the file replacing it.
+func manifestSizes(manifest archiveManifest, targetPath func(string) (string, error), freesReplaced bool) map[string]int64 {
+	sizes := map[string]int64{}
+	for _, entry := range manifest.Files {
+		target, err := targetPath(entry.Path)
+		if err != nil {
+			continue
+		}
+
+		size := entry.Size
+		if freesReplaced {
+			if size -= replacedSize(target); size < 0 {
+				size = 0
+			}
+		}
+		sizes[filepath.Dir(target)] += size
+	}
+	return sizes
+}
+
+// replacedSize returns the disk space freed by replacing the file at pth,
+// the space allocated for it if it is a regular file without other hard links.
+func replacedSize(pth string) int64 {
+	info, err := os.Lstat(pth)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.Size()
+	}
+	if st.Nlink > 1 {
+		return 0
+	}
+	return int64(st.Blocks) * 512
+}
+
+// archiveLength returns the length of the archive streamed by r, or -1 if it is unknown.
+func archiveLength(r io.Reader) int64 {
+	switch r := r.(type) {
+	case *os.File:
+		info, err := r.Stat()
+		if err != nil {
+			return -1
+		}
+		return info.Size()
+	case responseBody:
+		return r.length
+	case *rangeReader:
+		return r.size
+	case *multiPartReader:
+		return r.length()
+	default:
+		return -1
+	}
+}
+
+// filesystemUsages groups the required space of the given target paths per filesystem.
+func filesystemUsages(sizes map[string]int64) ([]filesystemUsage, error) {
+	byDevice := map[uint64]*filesystemUsage{}
+	var usages []*filesystemUsage
+	for pth, size := range sizes {
+		dir, dev, err := existingAncestor(pth)
+		if err != nil {
+			return nil, err
+		}
+
+		usage, ok := byDevice[dev]
+		if !ok {
+			free, err := freeSpace(dir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get free space of %s: %s", dir, err)
+			}
+			usage = &filesystemUsage{path: dir, device: dev, free: free}
+			byDevice[dev] = usage
+			usages = append(usages, usage)
+		}
+		usage.required += size
+	}
+
+	var result []filesystemUsage
+	for _, usage := range usages {
+		result = append(result, *usage)
+	}
+	return result, nil
+}
+
+// freeSpace returns the space available to the current user on the filesystem of pth.
+func freeSpace(pth string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(pth, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// String ...
+func (u filesystemUsage) String() string {
+	s := fmt.Sprintf("%s required, %s free on the filesystem of %s",
+		units.HumanSizeWithPrecision(float64(u.required), 3), units.HumanSizeWithPrecision(float64(u.free), 3), u.path)
+	if u.reserved > 0 {
+		s += fmt.Sprintf(", %s reserved by the other caches", units.HumanSizeWithPrecision(float64(u.reserved), 3))
+	}
+	return s
+}
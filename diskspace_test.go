@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_expectedSizes(t *testing.T) {
+	tests := []struct {
+		name        string
+		archiveInfo string
+		length      int64
+		compressed  bool
+		want        map[string]int64
+		wantOK      bool
+	}{
+		{
+			name:        "sizes per path",
+			archiveInfo: `{"stack_id": "linux", "uncompressed_size": 30, "sizes": {"/root/.gradle": 10, "/tmp/pods": 20}}`,
+			length:      5,
+			want:        map[string]int64{"/root/.gradle": 10, "/tmp/pods": 20},
+			wantOK:      true,
+		},
+		{
+			name:        "total size",
+			archiveInfo: `{"stack_id": "linux", "uncompressed_size": 30}`,
+			length:      5,
+			want:        map[string]int64{"/home": 30},
+			wantOK:      true,
+		},
+		{
+			name:       "estimated from compressed length",
+			length:     5,
+			compressed: true,
+			want:       map[string]int64{"/home": 5 * estimatedCompressionRatio},
+			wantOK:     true,
+		},
+		{
+			name:   "uncompressed length",
+			length: 5,
+			want:   map[string]int64{"/home": 5},
+			wantOK: true,
+		},
+		{
+			name:   "unknown",
+			length: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var archiveInfo []byte
+			if tt.archiveInfo != "" {
+				archiveInfo = []byte(tt.archiveInfo)
+			}
+
+			got, ok := expectedSizes(archiveInfo, tt.length, tt.compressed, "/home")
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expectedSizes() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func Test_filesystemUsages(t *testing.T) {
+	dir := t.TempDir()
+	usages, err := filesystemUsages(map[string]int64{dir + "/a/b": 10, dir + "/c": 20})
+	if err != nil {
+		t.Fatalf("filesystemUsages() error = %v", err)
+	}
+	if len(usages) != 1 || usages[0].required != 30 || usages[0].free <= 0 {
+		t.Errorf("filesystemUsages() = %v, want 30 bytes required on a single filesystem", usages)
+	}
+}
+
+func Test_reserveDiskSpace(t *testing.T) {
+	first, fits := reserveDiskSpace([]filesystemUsage{{path: "/", device: 1, required: 60, free: 100}})
+	if !fits {
+		t.Fatalf("reserveDiskSpace() of the first cache = false, want true")
+	}
+
+	usages := []filesystemUsage{{path: "/", device: 1, required: 60, free: 100}, {path: "/data", device: 2, required: 60, free: 100}}
+	if _, fits := reserveDiskSpace(usages); fits {
+		t.Errorf("reserveDiskSpace() next to the first cache's reservation = true, want false")
+	}
+	if usages[0].reserved != 60 || usages[1].reserved != 0 {
+		t.Errorf("reserved = %d, %d, want 60, 0", usages[0].reserved, usages[1].reserved)
+	}
+
+	first()
+	second, fits := reserveDiskSpace(usages)
+	if !fits {
+		t.Errorf("reserveDiskSpace() after the first cache's release = false, want true")
+	}
+	second()
+}
+
+func Test_manifestSizes(t *testing.T) {
+	dir := t.TempDir()
+	replaced := filepath.Join(dir, "replaced.bin")
+	if err := ioutil.WriteFile(replaced, make([]byte, 8192), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	linked := filepath.Join(dir, "linked.bin")
+	if err := ioutil.WriteFile(linked, make([]byte, 8192), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	if err := os.Link(linked, filepath.Join(dir, "link.bin")); err != nil {
+		t.Fatalf("failed to link file: %s", err)
+	}
+
+	manifest := archiveManifest{Files: []manifestEntry{
+		{Path: replaced, Size: 100000},
+		{Path: linked, Size: 100000},
+		{Path: filepath.Join(dir, "new/file.bin"), Size: 100},
+	}}
+	targetPath := func(name string) (string, error) { return name, nil }
+
+	freed := replacedSize(replaced)
+	if freed <= 0 {
+		t.Fatalf("replacedSize() = %d, want the allocated size", freed)
+	}
+	if got := replacedSize(linked); got != 0 {
+		t.Errorf("replacedSize() of a hard linked file = %d, want 0", got)
+	}
+
+	want := map[string]int64{dir: 200000 - freed, filepath.Join(dir, "new"): 100}
+	if got := manifestSizes(manifest, targetPath, true); !reflect.DeepEqual(got, want) {
+		t.Errorf("manifestSizes() = %v, want %v", got, want)
+	}
+	want = map[string]int64{dir: 200000, filepath.Join(dir, "new"): 100}
+	if got := manifestSizes(manifest, targetPath, false); !reflect.DeepEqual(got, want) {
+		t.Errorf("manifestSizes() without freeing the replaced files = %v, want %v", got, want)
+	}
+}
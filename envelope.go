@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// An encrypted cache archive is the archive wrapped in a chunked AES-256-GCM envelope:
+//
+//	header: magic (8 bytes) | version (1 byte) | chunk size (uint32, big endian) | nonce prefix (7 bytes)
+//	chunks: AES-256-GCM sealed chunks of chunk size plaintext bytes, the last one can be shorter
+//
+// The nonce of a chunk is the nonce prefix, the chunk index (uint32, big endian) and a last chunk flag (1 byte),
+// and the header is the additional data of every chunk, so reordered, truncated or modified archives fail to decrypt.
+const (
+	envelopeMagic       = "CACHEENC"
+	envelopeVersion     = 1
+	envelopeHeaderSize  = len(envelopeMagic) + 1 + 4 + envelopeNoncePrefix
+	envelopeNoncePrefix = 7
+	// maxEnvelopeChunkSize limits the memory used by a chunk of a corrupted or malicious header.
+	maxEnvelopeChunkSize = 16 << 20
+	encryptionKeySize    = 32
+)
+
+var errNoEncryptionKey = errors.New("cache archive is encrypted, but no encryption key is specified")
+
+// parseEncryptionKey decodes a 32 bytes key given as hex or base64.
+// The returned errors never contain the key.
+func parseEncryptionKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	if key, err := hex.DecodeString(s); err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key should be %d bytes, encoded as hex or base64", encryptionKeySize)
+}
+
+// openEnvelope returns a reader of the decrypted archive if r is an encrypted archive, otherwise a reader of r as is.
+// It reports whether the archive is encrypted.
+func openEnvelope(r io.Reader, key []byte) (io.Reader, bool, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(envelopeMagic))
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	if string(magic) != envelopeMagic {
+		return br, false, nil
+	}
+
+	if key == nil {
+		return nil, true, errNoEncryptionKey
+	}
+
+	dr, err := newDecryptingReader(br, key)
+	return dr, true, err
+}
+
+// decryptingReader reads the plaintext of an encrypted archive chunk by chunk.
+type decryptingReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+
+	chunk []byte
+	plain []byte
+	index uint32
+	done  bool
+}
+
+func newDecryptingReader(r *bufio.Reader, key []byte) (*decryptingReader, error) {
+	header := make([]byte, envelopeHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %s", err)
+	}
+
+	if version := header[len(envelopeMagic)]; version != envelopeVersion {
+		return nil, fmt.Errorf("unsupported encryption version: %d", version)
+	}
+	chunkSize := binary.BigEndian.Uint32(header[len(envelopeMagic)+1:])
+	if chunkSize == 0 || chunkSize > maxEnvelopeChunkSize {
+		return nil, fmt.Errorf("invalid encryption chunk size: %d", chunkSize)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptingReader{
+		r:      r,
+		aead:   aead,
+		header: header,
+		prefix: header[envelopeHeaderSize-envelopeNoncePrefix:],
+		chunk:  make([]byte, int(chunkSize)+aead.Overhead()),
+	}, nil
+}
+
+// Read implements the io.Reader interface.
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk. A chunk is the last one if nothing follows it.
+func (d *decryptingReader) next() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		d.done = true
+	} else if err != nil {
+		return err
+	} else if _, err := d.r.Peek(1); err == io.EOF {
+		d.done = true
+	} else if err != nil {
+		return err
+	}
+
+	plain, err := d.aead.Open(d.chunk[:0], d.nonce(d.done), d.chunk[:n], d.header)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt cache archive chunk %d: wrong encryption key, or the archive is corrupted or truncated", d.index)
+	}
+	d.plain = plain
+	d.index++
+	return nil
+}
+
+func (d *decryptingReader) nonce(last bool) []byte {
+	nonce := make([]byte, d.aead.NonceSize())
+	copy(nonce, d.prefix)
+	binary.BigEndian.PutUint32(nonce[envelopeNoncePrefix:], d.index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
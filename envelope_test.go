@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// encryptTestArchive wraps plain in an encryption envelope, the way the cache push step does.
+func encryptTestArchive(t *testing.T, plain, key []byte, chunkSize int) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("failed to create cipher: %s", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatalf("failed to create GCM: %s", err)
+	}
+
+	header := []byte(envelopeMagic)
+	header = append(header, envelopeVersion)
+	header = append(header, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[len(envelopeMagic)+1:], uint32(chunkSize))
+	header = append(header, []byte("prefix!")...)
+
+	out := append([]byte{}, header...)
+	for i := 0; ; i++ {
+		end := (i + 1) * chunkSize
+		last := end >= len(plain)
+		if last {
+			end = len(plain)
+		}
+
+		nonce := make([]byte, aead.NonceSize())
+		copy(nonce, "prefix!")
+		binary.BigEndian.PutUint32(nonce[envelopeNoncePrefix:], uint32(i))
+		if last {
+			nonce[len(nonce)-1] = 1
+		}
+		out = aead.Seal(out, nonce, plain[i*chunkSize:end], header)
+
+		if last {
+			return out
+		}
+	}
+}
+
+func TestOpenEnvelope(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, encryptionKeySize)
+	plain := []byte(strings.Repeat("cache archive content ", 100))
+	encrypted := encryptTestArchive(t, plain, key, 64)
+
+	tests := []struct {
+		name      string
+		archive   []byte
+		key       []byte
+		want      []byte
+		encrypted bool
+		wantErr   bool
+	}{
+		{name: "encrypted", archive: encrypted, key: key, want: plain, encrypted: true},
+		{name: "exact chunks", archive: encryptTestArchive(t, plain[:128], key, 64), key: key, want: plain[:128], encrypted: true},
+		{name: "not encrypted", archive: plain, key: key, want: plain},
+		{name: "wrong key", archive: encrypted, key: bytes.Repeat([]byte{8}, encryptionKeySize), encrypted: true, wantErr: true},
+		{name: "truncated", archive: encrypted[:len(encrypted)-80], key: key, encrypted: true, wantErr: true},
+		{name: "no key", archive: encrypted, encrypted: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, encrypted, err := openEnvelope(bytes.NewReader(tt.archive), tt.key)
+			if encrypted != tt.encrypted {
+				t.Errorf("openEnvelope() encrypted = %v, want %v", encrypted, tt.encrypted)
+			}
+			var got []byte
+			if err == nil {
+				got, err = ioutil.ReadAll(r)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reading the archive error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, tt.want) {
+				t.Errorf("decrypted archive = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseEncryptionKey(t *testing.T) {
+	want := bytes.Repeat([]byte{0xab}, encryptionKeySize)
+
+	for _, s := range []string{strings.Repeat("ab", encryptionKeySize), "q6urq6urq6urq6urq6urq6urq6urq6urq6urq6urq6s=\n"} {
+		key, err := parseEncryptionKey(s)
+		if err != nil {
+			t.Fatalf("parseEncryptionKey() error = %v", err)
+		}
+		if !bytes.Equal(key, want) {
+			t.Errorf("parseEncryptionKey() = %x, want %x", key, want)
+		}
+	}
+
+	secret := "not-a-valid-key"
+	if _, err := parseEncryptionKey(secret); err == nil || strings.Contains(err.Error(), secret) {
+		t.Errorf("parseEncryptionKey() error = %v, want an error without the key", err)
+	}
+	if _, err := parseEncryptionKey(""); err != nil {
+		t.Errorf("parseEncryptionKey() error = %v for empty key", err)
+	}
+}
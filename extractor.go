@@ -0,0 +1,782 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// conflictPolicy tells the extractor what to do with an entry whose target path already exists.
+type conflictPolicy string
+
+const (
+	conflictOverwrite    conflictPolicy = "overwrite"
+	conflictSkipExisting conflictPolicy = "skip-existing"
+	conflictKeepNewer    conflictPolicy = "keep-newer"
+	conflictFail         conflictPolicy = "fail"
+)
+
+// extractOptions configures how the cache archive is extracted.
+type extractOptions struct {
+	Relative   bool
+	Compressed bool
+	OnConflict conflictPolicy
+	Staged     bool
+	Rollback   bool
+	Workers    int
+	PunchHoles bool
+	Whiteouts  bool
+	Include    includeFilter
+	Portable   includeFilter
+	Exclude    includeFilter
+	Limits     extractLimits
+	Paths      pathPolicy
+}
+
+// pendingDir is an extracted directory whose permissions and modification time are set once its content is written,
+// so a read-only directory can still be filled and its modification time is not changed by its children.
+type pendingDir struct {
+	target  string
+	mode    os.FileMode
+	modTime time.Time
+	hdr     *tar.Header
+}
+
+// conflictError is returned when an entry's target already exists and the conflict policy is fail.
+type conflictError struct {
+	Path string
+}
+
+func (e conflictError) Error() string {
+	return fmt.Sprintf("%s already exists", e.Path)
+}
+
+// extractor writes the entries of a tar archive to the filesystem.
+// The same extractor can be reused for a retry: paths it has written are not reported as conflicts again.
+type extractor struct {
+	opts     extractOptions
+	report   *restoreReport
+	staging  *stagingArea
+	journal  *journal
+	manifest *archiveManifest
+	// archiveInfo is the content of the archive info, if it is the last entry of the archive
+	archiveInfo []byte
+	// manifestCheck is called with the manifest if it is read before any entry of the archive is restored
+	manifestCheck func(archiveManifest) error
+	// restoring is set once an entry of the archive is written
+	restoring bool
+
+	pool *writerPool
+	// pooled are the files queued for the writer pool (true) and their parent dirs (false)
+	pooled      map[string]bool
+	dirs        []pendingDir
+	sparseSaved int64
+	entries     int
+	totalSize   int64
+
+	written  map[string]bool
+	final    map[string]bool
+	reported map[string]bool
+	blocked  map[string]bool
+	// skipped are the targets not written because of the conflict policy
+	skipped map[string]bool
+	// symlinks are the restored symlinks, entries are not written through them
+	symlinks map[string]bool
+	// realPaths is the path policy for the paths with resolved symlinks
+	realPaths pathPolicy
+	// realParents caches the resolved parent directories,
+	// the symlinks changed by the archive are tracked in symlinks
+	realParents map[string]string
+}
+
+func newExtractor(opts extractOptions, report *restoreReport) *extractor {
+	e := &extractor{
+		opts:        opts,
+		report:      report,
+		written:     map[string]bool{},
+		final:       map[string]bool{},
+		reported:    map[string]bool{},
+		blocked:     map[string]bool{},
+		skipped:     map[string]bool{},
+		symlinks:    map[string]bool{},
+		realPaths:   opts.Paths.resolved(),
+		realParents: map[string]string{},
+	}
+	if opts.Rollback {
+		e.journal = newJournal()
+	}
+	return e
+}
+
+// extract reads the archive from r and writes each entry to its target path.
+// With staging enabled nothing is moved to its final location unless the whole archive could be read.
+func (e *extractor) extract(r io.Reader) error {
+	e.dirs = nil
+	if !e.opts.Staged {
+		if err := e.extractEntries(r); err != nil {
+			return err
+		}
+		return e.setDirAttributes()
+	}
+
+	e.staging = newStagingArea()
+	defer func() {
+		e.staging.cleanup()
+		e.staging = nil
+	}()
+
+	if err := e.extractEntries(r); err != nil {
+		return err
+	}
+
+	// the commit is journaled even without rollback, so a failed commit leaves the existing files untouched
+	j := e.journal
+	if j == nil {
+		j = newJournal()
+	}
+	committed, err := e.staging.commit(j)
+	if e.journal == nil {
+		if err != nil {
+			if rErr := j.rollback(); rErr != nil {
+				log.Warnf("Failed to roll back the moved files: %s", rErr)
+			}
+			return err
+		}
+		j.discard()
+	}
+
+	for _, entry := range committed {
+		if entry.whiteout {
+			e.forget(entry.target)
+		} else {
+			e.written[entry.target] = true
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return e.setDirAttributes()
+}
+
+// setDirAttributes applies the archive's permissions and modification times to the extracted directories,
+// deepest first, like tar does after extracting the directories' content.
+func (e *extractor) setDirAttributes() error {
+	sort.SliceStable(e.dirs, func(i, j int) bool { return len(e.dirs[i].target) > len(e.dirs[j].target) })
+	for _, dir := range e.dirs {
+		if err := setOwnerAndXattrs(dir.target, dir.hdr); err != nil {
+			if os.IsNotExist(err) {
+				// removed by a later whiteout
+				continue
+			}
+			return fmt.Errorf("failed to set the owner of %s: %s", dir.target, err)
+		}
+		if err := os.Chmod(dir.target, dir.mode); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("failed to set the permissions of %s: %s", dir.target, err)
+		}
+		if err := os.Chtimes(dir.target, dir.modTime, dir.modTime); err != nil {
+			return fmt.Errorf("failed to set the modification time of %s: %s", dir.target, err)
+		}
+	}
+	e.dirs = nil
+	return nil
+}
+
+// rollback undoes everything written since the last finish call, if rollback is enabled.
+func (e *extractor) rollback() error {
+	if e.journal == nil {
+		return nil
+	}
+
+	e.written = map[string]bool{}
+	for target := range e.final {
+		e.written[target] = true
+	}
+	return e.journal.rollback()
+}
+
+// verify checks a sample of the restored files against the archive manifest.
+// It returns false if the archive has no manifest.
+func (e *extractor) verify(rate float64) (int, []manifestMismatch, bool) {
+	if e.manifest == nil {
+		return 0, nil, false
+	}
+
+	checked, mismatches := verifyManifest(*e.manifest, rate, func(name string) (string, bool) {
+		target, err := e.targetPath(name)
+		if err != nil {
+			return "", true
+		}
+		if e.written[target] {
+			return target, false
+		}
+		return target, e.skipped[target] || !e.selected(name) || e.blocked[name] || !e.opts.Paths.allows(target)
+	})
+	return checked, mismatches, true
+}
+
+// enableRollback journals the restored paths until the next finish call, even if rollback is not enabled.
+func (e *extractor) enableRollback() {
+	if e.journal != nil {
+		return
+	}
+
+	e.journal = newJournal()
+	for target := range e.written {
+		e.final[target] = true
+	}
+}
+
+// finish drops the rollback journal once the restored files are final.
+func (e *extractor) finish() {
+	if e.journal != nil {
+		e.journal.discard()
+		for target := range e.written {
+			e.final[target] = true
+		}
+		if !e.opts.Rollback {
+			e.journal = nil
+		}
+	}
+}
+
+func (e *extractor) extractEntries(r io.Reader) error {
+	if e.opts.Workers > 1 {
+		e.pool = newWriterPool(e.opts.Workers, e.journal.begin)
+		e.pooled = map[string]bool{}
+		defer func() {
+			e.pool = nil
+		}()
+	}
+
+	e.manifest = nil
+	e.archiveInfo = nil
+	e.restoring = false
+	e.entries, e.totalSize = 0, 0
+	e.sparseSaved = 0
+	defer func() {
+		e.report.SparseBytesSaved += e.sparseSaved
+	}()
+
+	err := walkArchive(r, e.opts.Compressed, e.extractEntry)
+	if e.pool != nil {
+		if pErr := e.pool.close(); err == nil {
+			err = pErr
+		}
+		e.sparseSaved += e.pool.skipped()
+	}
+	return err
+}
+
+func (e *extractor) extractEntry(r io.Reader, hdr *tar.Header) error {
+	e.entries++
+	e.totalSize += hdr.Size
+	if err := e.opts.Limits.check(hdr, e.entries, e.totalSize); err != nil {
+		return err
+	}
+
+	target, err := e.targetPath(hdr.Name)
+	if err != nil {
+		return err
+	}
+
+	if isMetadataEntry(hdr, manifestFileName) {
+		// the manifest describes the archive, it is not restored
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("failed to read archive manifest: %s", err)
+		}
+		manifest, err := parseManifest(b)
+		if err != nil {
+			return fmt.Errorf("failed to parse archive manifest: %s", err)
+		}
+		e.manifest = &manifest
+		if e.manifestCheck != nil && !e.restoring {
+			return e.manifestCheck(manifest)
+		}
+		return nil
+	}
+
+	// only the archive's last entry can be its trailing archive info
+	e.archiveInfo = nil
+	if isMetadataEntry(hdr, archiveInfoFileName) && hdr.Size <= maxArchiveInfoSize {
+		// the archive info describes the archive, it is not restored
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("failed to read archive info: %s", err)
+		}
+		e.archiveInfo = b
+		return nil
+	}
+
+	if e.opts.Whiteouts {
+		if filepath.Base(target) == opaqueWhiteout {
+			log.Warnf("Opaque whiteouts are not supported, ignoring %s", hdr.Name)
+			return nil
+		}
+		if whiteout, ok := whiteoutTarget(target); ok {
+			if !e.selected(whiteoutName(hdr.Name)) {
+				return nil
+			}
+			if !e.allowedPath(whiteout) {
+				e.block(hdr.Name)
+				return nil
+			}
+			return e.removeWhiteout(whiteout)
+		}
+	}
+
+	if !e.selected(hdr.Name) {
+		return nil
+	}
+	if !e.allowed(target, hdr) {
+		e.block(hdr.Name)
+		return nil
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir, tar.TypeReg, tar.TypeGNUSparse, tar.TypeSymlink, tar.TypeLink, tar.TypeFifo, tar.TypeChar, tar.TypeBlock:
+	default:
+		log.Debugf("Skipping unsupported entry (type %c): %s", hdr.Typeflag, hdr.Name)
+		return nil
+	}
+
+	write, err := e.checkConflict(target, hdr)
+	if err != nil || !write {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		e.dirs = append(e.dirs, pendingDir{target: target, mode: hdr.FileInfo().Mode().Perm(), modTime: hdr.ModTime, hdr: hdr})
+	case tar.TypeSymlink:
+		e.symlinks[target] = true
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		delete(e.symlinks, target)
+	}
+
+	e.restoring = true
+	dst := target
+	if e.staging != nil {
+		if hdr.Typeflag == tar.TypeDir {
+			e.staging.addDir(target)
+			return nil
+		}
+
+		if dst, err = e.staging.path(target); err != nil {
+			return err
+		}
+		e.staging.addFile(target, dst)
+	} else {
+		if err := e.journal.record(target); err != nil {
+			return err
+		}
+		e.written[target] = true
+	}
+
+	if err := e.writeEntry(dst, r, hdr); err != nil {
+		return fmt.Errorf("failed to extract %s: %s", hdr.Name, err)
+	}
+	return nil
+}
+
+// selected reports whether the entry is selected for restoring by the include, portable and exclude filters.
+func (e *extractor) selected(name string) bool {
+	if !e.opts.Include.match(name) || !e.opts.Portable.match(name) {
+		return false
+	}
+	return len(e.opts.Exclude) == 0 || !e.opts.Exclude.match(name)
+}
+
+// allowed applies the path policy to the entry's target and, for links, to the path the link points to.
+func (e *extractor) allowed(target string, hdr *tar.Header) bool {
+	if !e.allowedPath(target) {
+		return false
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		linkTarget := hdr.Linkname
+		if !filepath.IsAbs(linkTarget) {
+			linkTarget = filepath.Join(filepath.Dir(target), linkTarget)
+		}
+		return e.allowedPath(linkTarget)
+	case tar.TypeLink:
+		linkTarget, err := e.targetPath(hdr.Linkname)
+		return err != nil || e.allowedPath(linkTarget)
+	}
+	return true
+}
+
+// allowedPath applies the path policy to pth as written and to where it really is, after resolving the symlinks of its parent.
+// Paths under a symlink restored from the archive are refused, as with staging enabled the symlink is not on disk yet.
+func (e *extractor) allowedPath(pth string) bool {
+	if e.opts.Paths.empty() {
+		return true
+	}
+	if !e.opts.Paths.allows(pth) {
+		return false
+	}
+
+	parent := filepath.Dir(pth)
+	for dir := parent; ; dir = filepath.Dir(dir) {
+		if e.symlinks[dir] {
+			return false
+		}
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	realParent, ok := e.realParents[parent]
+	if !ok {
+		var err error
+		if realParent, err = resolvePath(parent); err != nil {
+			log.Debugf("Failed to resolve %s: %s", parent, err)
+			return false
+		}
+		e.realParents[parent] = realParent
+	}
+	return e.realPaths.allows(filepath.Join(realParent, filepath.Base(pth)))
+}
+
+// block skips an entry refused by the path policy, listing it in the report once.
+func (e *extractor) block(name string) {
+	log.Debugf("Blocked by the path policy: %s", name)
+	if e.blocked[name] {
+		return
+	}
+	e.blocked[name] = true
+	e.report.Blocked = append(e.report.Blocked, name)
+}
+
+// removeWhiteout deletes a path restored by an earlier cache layer.
+// With staging enabled the path is only removed at commit, in archive order.
+func (e *extractor) removeWhiteout(target string) error {
+	if e.staging != nil {
+		e.staging.addWhiteout(target)
+		e.report.Whiteouts = append(e.report.Whiteouts, target)
+		return nil
+	}
+
+	if e.pool != nil {
+		// queued files may be written under the removed path
+		if err := e.pool.flush(); err != nil {
+			return err
+		}
+		e.pooled = map[string]bool{}
+	}
+
+	if err := e.journal.remove(target); err != nil {
+		return fmt.Errorf("failed to remove %s: %s", target, err)
+	}
+	e.forget(target)
+	e.report.Whiteouts = append(e.report.Whiteouts, target)
+	return nil
+}
+
+// forget drops target and everything under it from the written paths.
+func (e *extractor) forget(target string) {
+	prefix := target + string(filepath.Separator)
+	for pth := range e.written {
+		if pth == target || strings.HasPrefix(pth, prefix) {
+			delete(e.written, pth)
+		}
+	}
+}
+
+// writeEntry writes the entry to dst. With the writer pool enabled, small regular files are written
+// concurrently, everything else right away, once the queued files it could race with are written.
+func (e *extractor) writeEntry(dst string, r io.Reader, hdr *tar.Header) error {
+	// the files queued under a directory do not race with creating it
+	if err := e.waitForPool(dst, hdr.Typeflag != tar.TypeDir); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		linkTarget, err := e.linkTarget(hdr)
+		if err != nil {
+			return err
+		}
+		// the link gets the content its target has at this point of the archive
+		if err := e.waitForPool(linkTarget, false); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		// the archive's permissions are set at the end, the directory has to be writable until then
+		return e.guarded(func() error { return os.MkdirAll(dst, hdr.FileInfo().Mode().Perm()|dirWriteMode) })
+	case tar.TypeReg, tar.TypeGNUSparse:
+		if e.pool == nil || hdr.Size > maxPooledFileSize {
+			return e.guarded(func() error {
+				skipped, err := writeFile(dst, r, hdr, e.minHole(hdr))
+				e.sparseSaved += skipped
+				return err
+			})
+		}
+
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		e.queued(dst)
+		return e.pool.submit(writeJob{target: dst, content: content, hdr: hdr, minHole: e.minHole(hdr)})
+	case tar.TypeFifo, tar.TypeChar, tar.TypeBlock:
+		return e.guarded(func() error { return writeSpecial(dst, hdr) })
+	default:
+		return e.guarded(func() error { return e.writeLink(dst, hdr) })
+	}
+}
+
+// waitForPool waits for the queued files if writing dst could race with them: if a file is queued at dst
+// or at one of its parent dirs, or if under is set, also if files are queued under dst.
+func (e *extractor) waitForPool(dst string, under bool) error {
+	if e.pool == nil {
+		return nil
+	}
+
+	file, race := e.pooled[dst]
+	race = race && (file || under)
+	for dir := filepath.Dir(dst); !race && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		race = e.pooled[dir]
+	}
+	if !race {
+		return nil
+	}
+
+	if err := e.pool.flush(); err != nil {
+		return err
+	}
+	e.pooled = map[string]bool{}
+	return nil
+}
+
+// queued records a file queued for the writer pool, and its parent dirs.
+func (e *extractor) queued(dst string) {
+	e.pooled[dst] = true
+	for dir := filepath.Dir(dst); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if _, ok := e.pooled[dir]; ok {
+			break
+		}
+		e.pooled[dir] = false
+	}
+}
+
+// guarded runs a write of a recorded path, which a concurrent abort of the journal waits for.
+// Staged entries are not recorded, they are written to the staging dir.
+func (e *extractor) guarded(write func() error) error {
+	if e.staging != nil {
+		return write()
+	}
+
+	done := e.journal.begin()
+	defer done()
+	return write()
+}
+
+// minHole returns the shortest zero run to be turned into a hole when writing the entry, 0 means no holes.
+// Sparse entries always keep their holes, regular files only if hole punching is enabled.
+func (e *extractor) minHole(hdr *tar.Header) int64 {
+	if isSparseEntry(hdr) {
+		return sparseBlockSize
+	}
+	if e.opts.PunchHoles {
+		return minPunchedHoleSize
+	}
+	return 0
+}
+
+func (e *extractor) writeLink(dst string, hdr *tar.Header) error {
+	if hdr.Typeflag == tar.TypeSymlink {
+		return writeSymlink(dst, hdr)
+	}
+
+	linkTarget, err := e.linkTarget(hdr)
+	if err != nil {
+		return err
+	}
+	return writeHardlink(dst, linkTarget)
+}
+
+// linkTarget returns the path a hard link entry is linked to, its staging path if it is staged.
+func (e *extractor) linkTarget(hdr *tar.Header) (string, error) {
+	linkTarget, err := e.targetPath(hdr.Linkname)
+	if err != nil {
+		return "", err
+	}
+	if e.staging != nil {
+		linkTarget = e.staging.stagedPath(linkTarget)
+	}
+	return linkTarget, nil
+}
+
+// targetPath returns where an entry is extracted to. Like tar -P, absolute entry names are kept
+// unless relative extraction is requested, in which case the leading slash is stripped.
+func (e *extractor) targetPath(name string) (string, error) {
+	if e.opts.Relative {
+		name = strings.TrimLeft(name, "/")
+	}
+
+	pth := filepath.Clean(filepath.FromSlash(name))
+	if e.opts.Relative && (pth == ".." || strings.HasPrefix(pth, ".."+string(filepath.Separator))) {
+		return "", fmt.Errorf("entry %s points outside of the working directory", name)
+	}
+	return pth, nil
+}
+
+// checkConflict applies the conflict policy if the entry's target already exists and reports whether the entry should be written.
+func (e *extractor) checkConflict(target string, hdr *tar.Header) (bool, error) {
+	if e.written[target] {
+		return true, nil
+	}
+
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.IsDir() && hdr.Typeflag == tar.TypeDir {
+		// existing directories are merged, just like tar does
+		return true, nil
+	}
+
+	write := true
+	action := "overwritten"
+	switch e.opts.OnConflict {
+	case conflictSkipExisting:
+		write, action = false, "skipped"
+	case conflictKeepNewer:
+		if !hdr.ModTime.After(info.ModTime()) {
+			write, action = false, "kept newer existing file"
+		}
+	case conflictFail:
+		e.addConflict(target, "failed")
+		return false, conflictError{Path: target}
+	}
+
+	log.Debugf("%s already exists: %s", target, action)
+	if e.opts.OnConflict != conflictOverwrite {
+		// overwriting is the default, tar's behaviour: only the other policies' decisions are worth reporting
+		e.addConflict(target, action)
+	}
+	if !write {
+		e.skipped[target] = true
+	}
+	return write, nil
+}
+
+func (e *extractor) addConflict(target, action string) {
+	if e.reported[target] {
+		return
+	}
+	e.reported[target] = true
+	e.report.addConflict(target, action)
+}
+
+// writeFile writes a regular file. If minHole is not 0, zero runs of at least minHole bytes are
+// turned into holes and the number of bytes not allocated on disk this way is returned.
+func writeFile(target string, r io.Reader, hdr *tar.Header, minHole int64) (int64, error) {
+	if err := prepareTarget(target); err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, hdr.FileInfo().Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+
+	var skipped int64
+	if minHole > 0 {
+		w := newSparseWriter(f, minHole)
+		_, err = io.Copy(w, r)
+		if err == nil {
+			err = w.Close()
+		}
+		skipped = w.skipped
+	} else {
+		_, err = io.Copy(f, r)
+	}
+	if err != nil {
+		if cErr := f.Close(); cErr != nil {
+			log.Warnf("Failed to close %s: %s", target, cErr)
+		}
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	// the owner is set first, changing it clears the setuid and setgid bits
+	if err := setOwnerAndXattrs(target, hdr); err != nil {
+		return 0, err
+	}
+	// restore the exact permissions, not the ones filtered by the umask
+	if err := os.Chmod(target, hdr.FileInfo().Mode().Perm()); err != nil {
+		return 0, err
+	}
+	return skipped, os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+func writeSymlink(target string, hdr *tar.Header) error {
+	if err := prepareTarget(target); err != nil {
+		return err
+	}
+	if err := os.Symlink(hdr.Linkname, target); err != nil {
+		return err
+	}
+	return setOwnerAndXattrs(target, hdr)
+}
+
+func writeHardlink(target, linkTarget string) error {
+	if err := prepareTarget(target); err != nil {
+		return err
+	}
+	return os.Link(linkTarget, target)
+}
+
+// dirWriteMode is added to the permissions of the extracted directories until their content is written.
+const dirWriteMode os.FileMode = 0700
+
+// prepareTarget creates the parent directories of target and removes the file (not directory) already there.
+func prepareTarget(target string) error {
+	if err := prepareParent(target); err != nil {
+		return err
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// prepareParent creates the parent directories of target and checks that there is no directory at target.
+func prepareParent(target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("a directory already exists at %s", target)
+	}
+	return nil
+}
@@ -0,0 +1,978 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEntry struct {
+	name     string
+	content  string
+	typeflag byte
+	linkname string
+	modTime  time.Time
+	mode     int64
+	xattrs   map[string]string
+}
+
+func createTestArchive(t *testing.T, entries []testEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		typeflag := e.typeflag
+		if typeflag == 0 {
+			typeflag = tar.TypeReg
+		}
+		modTime := e.modTime
+		if modTime.IsZero() {
+			modTime = time.Now()
+		}
+
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(e.content)),
+			ModTime:  modTime,
+		}
+		if typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if e.mode != 0 {
+			hdr.Mode = e.mode
+		}
+		if typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		for name, value := range e.xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords[xattrPrefix+name] = value
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("failed to write header: %s", err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte(e.content)); err != nil {
+				t.Fatalf("failed to write content: %s", err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+	return &buf
+}
+
+func readTestFile(t *testing.T, pth string) string {
+	b, err := ioutil.ReadFile(pth)
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", pth, err)
+	}
+	return string(b)
+}
+
+func TestExtractor_conflictPolicies(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name          string
+		policy        conflictPolicy
+		archiveTime   time.Time
+		wantContent   string
+		wantAction    string
+		wantConflictE bool
+	}{
+		{name: "overwrite", policy: conflictOverwrite, archiveTime: past, wantContent: "cached"},
+		{name: "skip existing", policy: conflictSkipExisting, archiveTime: future, wantContent: "existing", wantAction: "skipped"},
+		{name: "keep newer, cached is older", policy: conflictKeepNewer, archiveTime: past, wantContent: "existing", wantAction: "kept newer existing file"},
+		{name: "keep newer, cached is newer", policy: conflictKeepNewer, archiveTime: future, wantContent: "cached", wantAction: "overwritten"},
+		{name: "fail", policy: conflictFail, archiveTime: past, wantContent: "existing", wantAction: "failed", wantConflictE: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			existing := filepath.Join(dir, "existing.txt")
+			if err := ioutil.WriteFile(existing, []byte("existing"), 0644); err != nil {
+				t.Fatalf("failed to create existing file: %s", err)
+			}
+
+			archive := createTestArchive(t, []testEntry{
+				{name: filepath.Join(dir, "new.txt"), content: "new"},
+				{name: existing, content: "cached", modTime: tt.archiveTime},
+			})
+
+			report := &restoreReport{}
+			e := newExtractor(extractOptions{OnConflict: tt.policy}, report)
+			err := e.extract(archive)
+
+			var cErr conflictError
+			if got := errors.As(err, &cErr); got != tt.wantConflictE {
+				t.Fatalf("extract() error = %v, want conflict error: %v", err, tt.wantConflictE)
+			}
+			if err != nil && !tt.wantConflictE {
+				t.Fatalf("extract() error = %v", err)
+			}
+
+			if got := readTestFile(t, existing); got != tt.wantContent {
+				t.Errorf("existing file content = %s, want %s", got, tt.wantContent)
+			}
+			if got := readTestFile(t, filepath.Join(dir, "new.txt")); got != "new" {
+				t.Errorf("new file content = %s, want %s", got, "new")
+			}
+
+			var want []restoreConflict
+			if tt.wantAction != "" {
+				want = []restoreConflict{{Path: existing, Action: tt.wantAction}}
+			}
+			if !reflect.DeepEqual(report.Conflicts, want) {
+				t.Errorf("report.Conflicts = %v, want %v", report.Conflicts, want)
+			}
+		})
+	}
+}
+
+func TestExtractor_retryDoesNotConflictWithItself(t *testing.T) {
+	dir := t.TempDir()
+	pth := filepath.Join(dir, "file.txt")
+	entries := []testEntry{{name: pth, content: "cached"}}
+
+	report := &restoreReport{}
+	e := newExtractor(extractOptions{OnConflict: conflictFail}, report)
+	if err := e.extract(createTestArchive(t, entries)); err != nil {
+		t.Fatalf("first extract() error = %v", err)
+	}
+	if err := e.extract(createTestArchive(t, entries)); err != nil {
+		t.Fatalf("second extract() error = %v", err)
+	}
+	if len(report.Conflicts) != 0 {
+		t.Errorf("report.Conflicts = %v, want none", report.Conflicts)
+	}
+}
+
+func TestExtractor_relative(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get working dir: %s", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("failed to change dir: %s", err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Errorf("failed to restore working dir: %s", err)
+		}
+	}()
+
+	archive := createTestArchive(t, []testEntry{
+		{name: "/tmp/cache/", typeflag: tar.TypeDir},
+		{name: "/tmp/cache/file.txt", content: "cached"},
+		{name: "/tmp/cache/link.txt", typeflag: tar.TypeSymlink, linkname: "file.txt"},
+	})
+
+	e := newExtractor(extractOptions{Relative: true}, &restoreReport{})
+	if err := e.extract(archive); err != nil {
+		t.Fatalf("extract() error = %v", err)
+	}
+	if got := readTestFile(t, filepath.Join(dir, "tmp/cache/link.txt")); got != "cached" {
+		t.Errorf("linked file content = %s, want %s", got, "cached")
+	}
+
+	traversal := createTestArchive(t, []testEntry{{name: "../outside.txt", content: "cached"}})
+	if err := e.extract(traversal); err == nil {
+		t.Errorf("extract() expected error for entry outside of the working directory")
+	}
+}
+
+func TestExtractor_staged(t *testing.T) {
+	dir := t.TempDir()
+	entries := []testEntry{
+		{name: filepath.Join(dir, "cache") + "/", typeflag: tar.TypeDir},
+		{name: filepath.Join(dir, "cache/file.txt"), content: "cached"},
+		{name: filepath.Join(dir, "cache/hardlink.txt"), typeflag: tar.TypeLink, linkname: filepath.Join(dir, "cache/file.txt")},
+	}
+
+	t.Log("failed extraction leaves no trace")
+	{
+		archive := createTestArchive(t, entries)
+		truncated := bytes.NewReader(archive.Bytes()[:archive.Len()-1100])
+
+		e := newExtractor(extractOptions{Staged: true}, &restoreReport{})
+		if err := e.extract(truncated); err == nil {
+			t.Fatalf("extract() expected error for truncated archive")
+		}
+
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("failed to read dir: %s", err)
+		}
+		if len(infos) != 0 {
+			t.Errorf("dir content = %v, want empty", infos)
+		}
+	}
+
+	t.Log("successful extraction moves entries into place")
+	{
+		e := newExtractor(extractOptions{Staged: true}, &restoreReport{})
+		if err := e.extract(createTestArchive(t, entries)); err != nil {
+			t.Fatalf("extract() error = %v", err)
+		}
+
+		if got := readTestFile(t, filepath.Join(dir, "cache/hardlink.txt")); got != "cached" {
+			t.Errorf("hard linked file content = %s, want %s", got, "cached")
+		}
+
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("failed to read dir: %s", err)
+		}
+		if len(infos) != 1 || infos[0].Name() != "cache" {
+			t.Errorf("dir content = %v, want only the cache dir", infos)
+		}
+	}
+
+	t.Log("failed commit leaves the existing files untouched")
+	{
+		existing := filepath.Join(dir, "cache/file.txt")
+		if err := ioutil.WriteFile(existing, []byte("existing"), 0644); err != nil {
+			t.Fatalf("failed to write existing file: %s", err)
+		}
+		// a file cannot replace the existing directory
+		archive := createTestArchive(t, []testEntry{
+			{name: existing, content: "cached"},
+			{name: filepath.Join(dir, "cache/new.txt"), content: "new"},
+			{name: filepath.Join(dir, "cache"), content: "not a dir"},
+		})
+
+		e := newExtractor(extractOptions{Staged: true}, &restoreReport{})
+		if err := e.extract(archive); err == nil {
+			t.Fatalf("extract() expected error for a file replacing a directory")
+		}
+
+		if got := readTestFile(t, existing); got != "existing" {
+			t.Errorf("existing file content = %s, want %s", got, "existing")
+		}
+		if _, err := os.Lstat(filepath.Join(dir, "cache/new.txt")); !os.IsNotExist(err) {
+			t.Errorf("new file should be removed, Lstat() error = %v", err)
+		}
+		infos, err := ioutil.ReadDir(filepath.Join(dir, "cache"))
+		if err != nil {
+			t.Fatalf("failed to read dir: %s", err)
+		}
+		if len(infos) != 2 {
+			t.Errorf("cache dir content = %v, want only the existing files", infos)
+		}
+	}
+
+	t.Log("committed files can be rolled back")
+	{
+		existing := filepath.Join(dir, "cache/file.txt")
+		e := newExtractor(extractOptions{Staged: true, Rollback: true}, &restoreReport{})
+		if err := e.extract(createTestArchive(t, []testEntry{{name: existing, content: "cached"}})); err != nil {
+			t.Fatalf("extract() error = %v", err)
+		}
+		if got := readTestFile(t, existing); got != "cached" {
+			t.Errorf("file content = %s, want %s", got, "cached")
+		}
+
+		if err := e.rollback(); err != nil {
+			t.Fatalf("rollback() error = %v", err)
+		}
+		if got := readTestFile(t, existing); got != "existing" {
+			t.Errorf("file content after rollback = %s, want %s", got, "existing")
+		}
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("failed to read dir: %s", err)
+		}
+		if len(infos) != 1 {
+			t.Errorf("dir content = %v, want only the cache dir", infos)
+		}
+	}
+}
+
+func TestExtractor_dirAttributes(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, opts := range []extractOptions{{}, {Workers: 4}, {Staged: true}, {Staged: true, Workers: 4}} {
+		dir := t.TempDir()
+		readOnly := filepath.Join(dir, "mod")
+		archive := createTestArchive(t, []testEntry{
+			{name: readOnly + "/", typeflag: tar.TypeDir, mode: 0555, modTime: modTime},
+			{name: filepath.Join(readOnly, "sub") + "/", typeflag: tar.TypeDir, mode: 0555, modTime: modTime},
+			{name: filepath.Join(readOnly, "sub/go.mod"), content: "module sub", mode: 0444},
+		})
+
+		if err := newExtractor(opts, &restoreReport{}).extract(archive); err != nil {
+			t.Fatalf("extract() with %+v error = %v", opts, err)
+		}
+
+		if got := readTestFile(t, filepath.Join(readOnly, "sub/go.mod")); got != "module sub" {
+			t.Errorf("file content = %s, want %s", got, "module sub")
+		}
+		for _, pth := range []string{readOnly, filepath.Join(readOnly, "sub")} {
+			info, err := os.Stat(pth)
+			if err != nil {
+				t.Fatalf("failed to stat %s: %s", pth, err)
+			}
+			if info.Mode().Perm() != 0555 {
+				t.Errorf("%s mode = %s, want %s", pth, info.Mode().Perm(), os.FileMode(0555))
+			}
+			if !info.ModTime().Equal(modTime) {
+				t.Errorf("%s modification time = %s, want %s", pth, info.ModTime(), modTime)
+			}
+		}
+
+		// let the test cleanup remove the read-only dirs
+		for _, pth := range []string{readOnly, filepath.Join(readOnly, "sub")} {
+			if err := os.Chmod(pth, 0755); err != nil {
+				t.Fatalf("failed to chmod %s: %s", pth, err)
+			}
+		}
+	}
+}
+
+func TestExtractor_tarArgs(t *testing.T) {
+	deny := pathPolicy{Deny: []string{"/root/.ssh"}}
+	tests := []struct {
+		name   string
+		opts   extractOptions
+		gnu    bool
+		want   []string
+		wantOK bool
+	}{
+		{name: "overwrite", opts: extractOptions{OnConflict: conflictOverwrite, Compressed: true, Paths: deny}, gnu: true, want: []string{"--exclude", "/root/.ssh", "-xPzf"}, wantOK: true},
+		{name: "skip existing, GNU", opts: extractOptions{OnConflict: conflictSkipExisting}, gnu: true, want: []string{"--skip-old-files", "-xPf"}, wantOK: true},
+		{name: "skip existing, BSD", opts: extractOptions{OnConflict: conflictSkipExisting}, want: []string{"-k", "-xPf"}, wantOK: true},
+		{name: "fail, BSD", opts: extractOptions{OnConflict: conflictFail}},
+		{name: "include paths", opts: extractOptions{Include: includeFilter{"/root/.gradle"}}, gnu: true},
+		{name: "allowed paths", opts: extractOptions{Paths: pathPolicy{Allow: []string{"/root"}}}, gnu: true},
+		{name: "staged", opts: extractOptions{Staged: true}, gnu: true},
+		{name: "rollback", opts: extractOptions{Rollback: true}, gnu: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := newExtractor(tt.opts, &restoreReport{}).tarArgs(tt.gnu)
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tarArgs() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestExtractor_rollback(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.txt")
+	if err := ioutil.WriteFile(existing, []byte("existing"), 0644); err != nil {
+		t.Fatalf("failed to create existing file: %s", err)
+	}
+
+	archive := createTestArchive(t, []testEntry{
+		{name: existing, content: "cached"},
+		{name: filepath.Join(dir, "new/dir/file.txt"), content: "new"},
+		{name: filepath.Join(dir, "new/dir/other.txt"), content: "other"},
+	})
+	truncated := bytes.NewReader(archive.Bytes()[:archive.Len()-1600])
+
+	e := newExtractor(extractOptions{Rollback: true}, &restoreReport{})
+	if err := e.extract(truncated); err == nil {
+		t.Fatalf("extract() expected error for truncated archive")
+	}
+	if got := readTestFile(t, existing); got != "cached" {
+		t.Fatalf("existing file content before rollback = %s, want %s", got, "cached")
+	}
+
+	if err := e.rollback(); err != nil {
+		t.Fatalf("rollback() error = %v", err)
+	}
+
+	if got := readTestFile(t, existing); got != "existing" {
+		t.Errorf("existing file content = %s, want %s", got, "existing")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "new")); !os.IsNotExist(err) {
+		t.Errorf("created dir should be removed, Lstat() error = %v", err)
+	}
+}
+
+func TestExtractor_verify(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.txt")
+	bad := filepath.Join(dir, "bad.txt")
+	missing := filepath.Join(dir, "missing.txt")
+	excluded := filepath.Join(dir, "excluded/file.txt")
+
+	manifest := fmt.Sprintf(`{"files": [
+		{"path": "%s", "size": 4, "mode": 420, "sha256": "%x"},
+		{"path": "%s", "size": 4, "mode": 420, "sha256": "%x"},
+		{"path": "%s", "size": 4, "mode": 420, "sha256": "%x"},
+		{"path": "%s", "size": 4, "mode": 420, "sha256": "%x"}
+	]}`, good, sha256.Sum256([]byte("good")), bad, sha256.Sum256([]byte("nope")),
+		missing, sha256.Sum256([]byte("lost")), excluded, sha256.Sum256([]byte("excl")))
+
+	// a restored file with the manifest's name is not the manifest
+	nested := filepath.Join(dir, "node_modules/pkg", manifestFileName)
+	archive := createTestArchive(t, []testEntry{
+		{name: "./" + manifestFileName, content: manifest},
+		{name: good, content: "good"},
+		{name: bad, content: "baad"},
+		{name: excluded, content: "excl"},
+		{name: nested, content: "not json"},
+	})
+
+	e := newExtractor(extractOptions{Exclude: includeFilter{filepath.Join(dir, "excluded")}}, &restoreReport{})
+	if err := e.extract(archive); err != nil {
+		t.Fatalf("extract() error = %v", err)
+	}
+
+	if got := readTestFile(t, nested); got != "not json" {
+		t.Errorf("nested file content = %s, want not json", got)
+	}
+	if _, err := os.Lstat(manifestFileName); !os.IsNotExist(err) {
+		t.Errorf("the manifest should not be restored, Lstat() error = %v", err)
+	}
+
+	checked, mismatches, ok := e.verify(1)
+	if !ok {
+		t.Fatalf("verify() found no manifest")
+	}
+	if checked != 3 {
+		t.Errorf("verify() checked = %d, want %d", checked, 3)
+	}
+	want := []manifestMismatch{{Path: bad, Reason: fmt.Sprintf("sha256 is %x, expected %x", sha256.Sum256([]byte("baad")), sha256.Sum256([]byte("nope")))}, {Path: missing, Reason: "missing"}}
+	if !reflect.DeepEqual(mismatches, want) {
+		t.Errorf("verify() mismatches = %v, want %v", mismatches, want)
+	}
+}
+
+func TestExtractor_parallel(t *testing.T) {
+	dir := t.TempDir()
+
+	var entries []testEntry
+	for i := 0; i < 20; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("dir%d", i))
+		entries = append(entries,
+			testEntry{name: sub + "/", typeflag: tar.TypeDir},
+			testEntry{name: filepath.Join(sub, "file.txt"), content: sub},
+			testEntry{name: filepath.Join(sub, "hardlink.txt"), typeflag: tar.TypeLink, linkname: filepath.Join(sub, "file.txt")},
+			testEntry{name: filepath.Join(sub, "symlink.txt"), typeflag: tar.TypeSymlink, linkname: "file.txt"},
+		)
+	}
+	// the same path twice, the later entry wins, the hard link keeps the content its target had when it was linked
+	entries = append(entries, testEntry{name: filepath.Join(dir, "dir0/file.txt"), content: "overwritten"})
+	// a queued small file overwritten by a large one, which is not queued
+	large := strings.Repeat("l", maxPooledFileSize+1)
+	entries = append(entries,
+		testEntry{name: filepath.Join(dir, "large.txt"), content: "small"},
+		testEntry{name: filepath.Join(dir, "large.txt"), content: large},
+	)
+
+	e := newExtractor(extractOptions{Workers: 4}, &restoreReport{})
+	if err := e.extract(createTestArchive(t, entries)); err != nil {
+		t.Fatalf("extract() error = %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("dir%d", i))
+		want := map[string]string{"file.txt": sub, "symlink.txt": sub, "hardlink.txt": sub}
+		if i == 0 {
+			want["file.txt"], want["symlink.txt"] = "overwritten", "overwritten"
+		}
+		for name, content := range want {
+			if got := readTestFile(t, filepath.Join(sub, name)); got != content {
+				t.Errorf("%s content = %s, want %s", filepath.Join(sub, name), got, content)
+			}
+		}
+	}
+	if got := readTestFile(t, filepath.Join(dir, "large.txt")); got != large {
+		t.Errorf("large.txt content has %d bytes, want %d", len(got), len(large))
+	}
+}
+
+func TestExtractor_punchHoles(t *testing.T) {
+	dir := t.TempDir()
+	pth := filepath.Join(dir, "image.img")
+
+	content := append([]byte("head"), make([]byte, 3*minPunchedHoleSize)...)
+	content = append(content, []byte("middle")...)
+	content = append(content, make([]byte, 2*minPunchedHoleSize)...)
+
+	report := &restoreReport{}
+	e := newExtractor(extractOptions{PunchHoles: true}, report)
+	if err := e.extract(createTestArchive(t, []testEntry{{name: pth, content: string(content)}})); err != nil {
+		t.Fatalf("extract() error = %v", err)
+	}
+
+	if got := readTestFile(t, pth); got != string(content) {
+		t.Errorf("restored content differs from the archived one")
+	}
+	if report.SparseBytesSaved < 4*minPunchedHoleSize {
+		t.Errorf("report.SparseBytesSaved = %d, want at least %d", report.SparseBytesSaved, 4*minPunchedHoleSize)
+	}
+}
+
+// sparseFragment is a data region of a sparse test file, the rest of the file is a hole.
+type sparseFragment struct {
+	offset  int64
+	content string
+}
+
+// createPAXSparseArchive writes a PAX 1.0 sparse entry, as GNU tar does with --sparse --format=posix.
+// The writer of archive/tar drops the GNU.sparse records, so the PAX header is written as a regular entry and patched.
+func createPAXSparseArchive(t *testing.T, name string, realSize int64, fragments []sparseFragment) *bytes.Buffer {
+	var records string
+	for _, record := range [][2]string{
+		{"GNU.sparse.major", "1"},
+		{"GNU.sparse.minor", "0"},
+		{"GNU.sparse.name", name},
+		{"GNU.sparse.realsize", strconv.FormatInt(realSize, 10)},
+	} {
+		records += paxRecord(record[0], record[1])
+	}
+
+	sparseMap := fmt.Sprintf("%d\n", len(fragments))
+	var data string
+	for _, f := range fragments {
+		sparseMap += fmt.Sprintf("%d\n%d\n", f.offset, len(f.content))
+		data += f.content
+	}
+	content := sparseMap + strings.Repeat("\x00", 512-len(sparseMap)%512) + data
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	dir, base := filepath.Dir(name), filepath.Base(name)
+	for _, entry := range []struct{ name, content string }{
+		{name: filepath.Join(dir, "PaxHeaders.0", base), content: records},
+		{name: filepath.Join(dir, "GNUSparseFile.0", base), content: content},
+	} {
+		hdr := &tar.Header{Name: entry.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(entry.content)), ModTime: time.Now(), Format: tar.FormatUSTAR}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("failed to write header: %s", err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatalf("failed to write content: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+
+	patchHeader(buf.Bytes()[:512], func(block []byte) {
+		block[156] = tar.TypeXHeader
+	})
+	return &buf
+}
+
+// paxRecord formats a PAX record, its length includes the length field itself.
+func paxRecord(key, value string) string {
+	record := " " + key + "=" + value + "\n"
+	size := len(record)
+	for size < len(strconv.Itoa(size))+len(record) {
+		size++
+	}
+	return strconv.Itoa(size) + record
+}
+
+// createGNUSparseArchive writes an old GNU sparse (type S) entry, as GNU tar does with --sparse --format=gnu.
+// The writer of archive/tar does not support sparse entries, so a regular GNU header is patched.
+func createGNUSparseArchive(t *testing.T, name string, realSize int64, fragments []sparseFragment) *bytes.Buffer {
+	if len(fragments) > 4 {
+		t.Fatalf("at most 4 fragments fit into the header")
+	}
+
+	var data string
+	for _, f := range fragments {
+		data += f.content
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data)), ModTime: time.Now(), Format: tar.FormatGNU}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatalf("failed to write header: %s", err)
+	}
+	if _, err := tw.Write([]byte(data)); err != nil {
+		t.Fatalf("failed to write content: %s", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+
+	patchHeader(buf.Bytes()[:512], func(block []byte) {
+		octal := func(offset int, value int64) {
+			copy(block[offset:offset+12], fmt.Sprintf("%011o\x00", value))
+		}
+		block[156] = tar.TypeGNUSparse
+		for i, f := range fragments {
+			octal(386+i*24, f.offset)
+			octal(386+i*24+12, int64(len(f.content)))
+		}
+		octal(483, realSize)
+	})
+	return &buf
+}
+
+// patchHeader changes a tar header block and updates its checksum.
+func patchHeader(block []byte, patch func(block []byte)) {
+	patch(block)
+
+	copy(block[148:156], "        ")
+	var sum int64
+	for _, b := range block {
+		sum += int64(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+}
+
+func TestExtractor_sparseEntries(t *testing.T) {
+	const realSize = 32 * sparseBlockSize
+	fragments := []sparseFragment{
+		{offset: 0, content: strings.Repeat("a", sparseBlockSize)},
+		{offset: 16 * sparseBlockSize, content: strings.Repeat("b", sparseBlockSize)},
+	}
+	want := fragments[0].content + strings.Repeat("\x00", 15*sparseBlockSize) + fragments[1].content + strings.Repeat("\x00", 15*sparseBlockSize)
+
+	tests := []struct {
+		name   string
+		create func(t *testing.T, name string, realSize int64, fragments []sparseFragment) *bytes.Buffer
+	}{
+		{name: "GNU", create: createGNUSparseArchive},
+		{name: "PAX", create: createPAXSparseArchive},
+	}
+	for _, tt := range tests {
+		for _, workers := range []int{1, 4} {
+			t.Run(fmt.Sprintf("%s, %d workers", tt.name, workers), func(t *testing.T) {
+				pth := filepath.Join(t.TempDir(), "emulator.img")
+
+				report := &restoreReport{}
+				e := newExtractor(extractOptions{Workers: workers}, report)
+				if err := e.extract(tt.create(t, pth, realSize, fragments)); err != nil {
+					t.Fatalf("extract() error = %v", err)
+				}
+
+				if got := readTestFile(t, pth); got != want {
+					t.Errorf("restored content differs from the sparse entry's content")
+				}
+				if want := int64(30 * sparseBlockSize); report.SparseBytesSaved != want {
+					t.Errorf("report.SparseBytesSaved = %d, want %d", report.SparseBytesSaved, want)
+				}
+			})
+		}
+	}
+}
+
+func TestExtractor_layers(t *testing.T) {
+	for _, staged := range []bool{false, true} {
+		t.Logf("staged: %v", staged)
+
+		dir := t.TempDir()
+		base := createTestArchive(t, []testEntry{
+			{name: filepath.Join(dir, "sdk") + "/", typeflag: tar.TypeDir},
+			{name: filepath.Join(dir, "sdk/tool"), content: "tool"},
+			{name: filepath.Join(dir, "removed.txt"), content: "removed"},
+			{name: filepath.Join(dir, "changed.txt"), content: "base"},
+		})
+		delta := []testEntry{
+			{name: filepath.Join(dir, ".wh.sdk"), content: ""},
+			{name: filepath.Join(dir, ".wh.removed.txt"), content: ""},
+			{name: filepath.Join(dir, "changed.txt"), content: "delta"},
+		}
+
+		report := &restoreReport{}
+		e := newExtractor(extractOptions{OnConflict: conflictFail, Staged: staged, Rollback: true}, report)
+		if err := e.extract(base); err != nil {
+			t.Fatalf("extract() base error = %v", err)
+		}
+		e.finish()
+
+		e.opts.Whiteouts = true
+		archive := createTestArchive(t, delta)
+		truncated := bytes.NewReader(archive.Bytes()[:archive.Len()-1600])
+		if err := e.extract(truncated); err == nil {
+			t.Fatalf("extract() expected error for truncated delta")
+		}
+		if err := e.rollback(); err != nil {
+			t.Fatalf("rollback() error = %v", err)
+		}
+		if got := readTestFile(t, filepath.Join(dir, "sdk/tool")); got != "tool" {
+			t.Errorf("rolled back whiteout content = %s, want %s", got, "tool")
+		}
+
+		if err := e.extract(createTestArchive(t, delta)); err != nil {
+			t.Fatalf("extract() delta error = %v", err)
+		}
+		e.finish()
+
+		for _, name := range []string{"sdk", "removed.txt"} {
+			if _, err := os.Lstat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				t.Errorf("%s should be removed by the whiteout, Lstat() error = %v", name, err)
+			}
+		}
+		if got := readTestFile(t, filepath.Join(dir, "changed.txt")); got != "delta" {
+			t.Errorf("overridden file content = %s, want %s", got, "delta")
+		}
+		if len(report.Conflicts) != 0 {
+			t.Errorf("conflicts = %v, want none", report.Conflicts)
+		}
+
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("failed to read dir: %s", err)
+		}
+		if len(infos) != 1 {
+			t.Errorf("dir content = %v, want only changed.txt", infos)
+		}
+	}
+}
+
+func TestExtractor_limits(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  extractLimits
+		wantErr bool
+	}{
+		{name: "no limits"},
+		{name: "within limits", limits: extractLimits{MaxTotalSize: 9, MaxFileSize: 5, MaxEntries: 3}},
+		{name: "too many entries", limits: extractLimits{MaxEntries: 2}, wantErr: true},
+		{name: "file too large", limits: extractLimits{MaxFileSize: 4}, wantErr: true},
+		{name: "total size too large", limits: extractLimits{MaxTotalSize: 8}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			archive := createTestArchive(t, []testEntry{
+				{name: filepath.Join(dir, "a"), content: "aaaa"},
+				{name: filepath.Join(dir, "b"), content: "bbbbb"},
+				{name: filepath.Join(dir, "dir") + "/", typeflag: tar.TypeDir},
+			})
+
+			e := newExtractor(extractOptions{Limits: tt.limits, Rollback: true}, &restoreReport{})
+			err := e.extract(archive)
+			var lErr limitError
+			if (err != nil) != tt.wantErr || (err != nil && !errors.As(err, &lErr)) {
+				t.Fatalf("extract() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				return
+			}
+
+			if err := e.rollback(); err != nil {
+				t.Fatalf("rollback() error = %v", err)
+			}
+			infos, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("failed to read dir: %s", err)
+			}
+			if len(infos) != 0 {
+				t.Errorf("dir content = %v, want empty after rollback", infos)
+			}
+		})
+	}
+}
+
+func TestExtractor_pathPolicy(t *testing.T) {
+	dir := t.TempDir()
+	archive := createTestArchive(t, []testEntry{
+		{name: filepath.Join(dir, "cache/a"), content: "a"},
+		{name: filepath.Join(dir, "cache/secret/key"), content: "key"},
+		{name: filepath.Join(dir, "cache/link"), typeflag: tar.TypeSymlink, linkname: "secret"},
+		{name: filepath.Join(dir, "cache/hardlink"), typeflag: tar.TypeLink, linkname: filepath.Join(dir, "cache/secret/key")},
+		{name: filepath.Join(dir, "other/b"), content: "b"},
+	})
+
+	report := &restoreReport{}
+	paths := pathPolicy{Allow: []string{filepath.Join(dir, "cache")}, Deny: []string{filepath.Join(dir, "cache/secret")}}
+	e := newExtractor(extractOptions{Paths: paths}, report)
+	if err := e.extract(archive); err != nil {
+		t.Fatalf("extract() error = %v", err)
+	}
+
+	if got := readTestFile(t, filepath.Join(dir, "cache/a")); got != "a" {
+		t.Errorf("allowed file content = %s, want %s", got, "a")
+	}
+	for _, name := range []string{"cache/secret", "cache/link", "cache/hardlink", "other"} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s should be blocked, Lstat() error = %v", name, err)
+		}
+	}
+	if len(report.Blocked) != 4 {
+		t.Errorf("blocked = %v, want 4 entries", report.Blocked)
+	}
+}
+
+func TestExtractor_pathPolicySymlink(t *testing.T) {
+	tests := []struct {
+		name   string
+		staged bool
+		link   bool
+	}{
+		{name: "symlink restored from the archive"},
+		{name: "symlink restored from the archive, staged", staged: true},
+		{name: "existing symlink", link: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			entries := []testEntry{
+				{name: filepath.Join(home, "x/a"), typeflag: tar.TypeSymlink, linkname: ".."},
+				{name: filepath.Join(home, "x/a/.ssh/authorized_keys"), content: "key"},
+			}
+			if tt.link {
+				if err := os.MkdirAll(filepath.Join(home, "x"), 0755); err != nil {
+					t.Fatalf("failed to create dir: %s", err)
+				}
+				if err := os.Symlink("..", filepath.Join(home, "x/a")); err != nil {
+					t.Fatalf("failed to create symlink: %s", err)
+				}
+				entries = entries[1:]
+			}
+
+			report := &restoreReport{}
+			paths := pathPolicy{Deny: []string{filepath.Join(home, ".ssh")}}
+			e := newExtractor(extractOptions{Paths: paths, Staged: tt.staged}, report)
+			if err := e.extract(createTestArchive(t, entries)); err != nil {
+				t.Fatalf("extract() error = %v", err)
+			}
+
+			if _, err := os.Lstat(filepath.Join(home, ".ssh")); !os.IsNotExist(err) {
+				t.Errorf("denied path should not be written through the symlink, Lstat() error = %v", err)
+			}
+			if want := []string{filepath.Join(home, "x/a/.ssh/authorized_keys")}; !reflect.DeepEqual(report.Blocked, want) {
+				t.Errorf("blocked = %v, want %v", report.Blocked, want)
+			}
+		})
+	}
+}
+
+func TestExtractor_portable(t *testing.T) {
+	dir := t.TempDir()
+	archiveInfo := []byte(`{"stack_id": "osx-xcode-15.0.x", "portable_paths": ["` + filepath.Join(dir, "gradle/wrapper") + `"]}`)
+	archive := createTestArchive(t, []testEntry{
+		{name: filepath.Join(dir, "gradle/wrapper/dists/gradle.zip"), content: "zip"},
+		{name: filepath.Join(dir, "gradle/caches/transforms"), content: "transforms"},
+		{name: filepath.Join(dir, "project/node_modules/.cache/babel"), content: "babel"},
+	})
+
+	portable := portablePaths(archiveInfo, includeFilter{filepath.Join(dir, "*/node_modules/.cache")})
+	e := newExtractor(extractOptions{Portable: portable}, &restoreReport{})
+	if err := e.extract(archive); err != nil {
+		t.Fatalf("extract() error = %v", err)
+	}
+
+	for _, name := range []string{"gradle/wrapper/dists/gradle.zip", "project/node_modules/.cache/babel"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("portable path %s should be restored: %s", name, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "gradle/caches")); !os.IsNotExist(err) {
+		t.Errorf("stack-bound path should not be restored, Lstat() error = %v", err)
+	}
+}
+
+func TestExtractor_specialFiles(t *testing.T) {
+	dir := t.TempDir()
+	fifo := filepath.Join(dir, "fifo")
+	archive := createTestArchive(t, []testEntry{{name: fifo, typeflag: tar.TypeFifo, mode: 0600}})
+
+	e := newExtractor(extractOptions{}, &restoreReport{})
+	if err := e.extract(archive); err != nil {
+		t.Fatalf("extract() error = %v", err)
+	}
+
+	info, err := os.Lstat(fifo)
+	if err != nil {
+		t.Fatalf("failed to stat fifo: %s", err)
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("fifo mode = %s, want a named pipe with 0600 permissions", info.Mode())
+	}
+}
+
+func TestExtractor_stagingRootOutsideRestoredTree(t *testing.T) {
+	dir := t.TempDir()
+	base := createTestArchive(t, []testEntry{{name: filepath.Join(dir, "sub/old.txt"), content: "old"}})
+	delta := createTestArchive(t, []testEntry{
+		{name: filepath.Join(dir, ".wh.sub"), content: ""},
+		{name: filepath.Join(dir, "sub/new.txt"), content: "new"},
+	})
+
+	e := newExtractor(extractOptions{Staged: true}, &restoreReport{})
+	if err := e.extract(base); err != nil {
+		t.Fatalf("extract() base error = %v", err)
+	}
+	e.opts.Whiteouts = true
+	if err := e.extract(delta); err != nil {
+		t.Fatalf("extract() delta error = %v", err)
+	}
+
+	if got := readTestFile(t, filepath.Join(dir, "sub/new.txt")); got != "new" {
+		t.Errorf("new file content = %s, want new", got)
+	}
+	infos, err := ioutil.ReadDir(filepath.Join(dir, "sub"))
+	if err != nil {
+		t.Fatalf("failed to read dir: %s", err)
+	}
+	if len(infos) != 1 {
+		t.Errorf("sub dir content = %v, want only new.txt", infos)
+	}
+}
+
+func TestExtractor_manifestCheck(t *testing.T) {
+	dir := t.TempDir()
+	manifest := `{"files": [{"path": "` + filepath.Join(dir, "file.txt") + `", "size": 4}]}`
+
+	tests := []struct {
+		name      string
+		entries   []testEntry
+		wantCheck bool
+	}{
+		{
+			name:      "manifest first",
+			entries:   []testEntry{{name: manifestFileName, content: manifest}, {name: filepath.Join(dir, "file.txt"), content: "file"}},
+			wantCheck: true,
+		},
+		{
+			name:    "manifest after a restored entry",
+			entries: []testEntry{{name: filepath.Join(dir, "file.txt"), content: "file"}, {name: manifestFileName, content: manifest}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checked := false
+			e := newExtractor(extractOptions{}, &restoreReport{})
+			e.manifestCheck = func(m archiveManifest) error {
+				checked = true
+				return diskSpaceError{}
+			}
+
+			err := e.extract(createTestArchive(t, tt.entries))
+			if checked != tt.wantCheck {
+				t.Fatalf("manifest checked = %v, want %v", checked, tt.wantCheck)
+			}
+			var dErr diskSpaceError
+			if got := errors.As(err, &dErr); got != tt.wantCheck {
+				t.Errorf("extract() error = %v, want disk space error: %v", err, tt.wantCheck)
+			}
+			if _, err := os.Lstat(filepath.Join(dir, "file.txt")); tt.wantCheck && !os.IsNotExist(err) {
+				t.Errorf("nothing should be restored, Lstat() error = %v", err)
+			}
+			if err := os.RemoveAll(filepath.Join(dir, "file.txt")); err != nil {
+				t.Fatalf("failed to clean up: %s", err)
+			}
+		})
+	}
+}
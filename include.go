@@ -0,0 +1,55 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+// includeFilter is a list of glob patterns selecting the archive entries to restore.
+// An empty filter selects every entry.
+type includeFilter []string
+
+// parseIncludeFilter parses the newline separated patterns.
+func parseIncludeFilter(s string) includeFilter {
+	return includeFilter(parsePathList(s))
+}
+
+// parsePathList parses a newline separated list of paths, expanding a leading ~ to the home directory.
+func parsePathList(s string) []string {
+	var paths []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line == "~" || strings.HasPrefix(line, "~/") {
+			line = filepath.Join(pathutil.UserHomeDir(), strings.TrimPrefix(line, "~"))
+		}
+		paths = append(paths, filepath.Clean(line))
+	}
+	return paths
+}
+
+// match reports whether the entry is selected: a pattern matches the entry's name or one of its parent directories.
+func (f includeFilter) match(name string) bool {
+	if len(f) == 0 {
+		return true
+	}
+
+	pth := filepath.Clean(filepath.FromSlash(name))
+	for {
+		for _, pattern := range f {
+			if ok, err := filepath.Match(pattern, pth); err == nil && ok {
+				return true
+			}
+		}
+
+		parent := filepath.Dir(pth)
+		if parent == pth {
+			return false
+		}
+		pth = parent
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// indexSuffix is appended to the archive URL to get the index's URL, if it is not specified.
+const indexSuffix = ".index.json"
+
+var errIndexNotFound = errors.New("archive index not found")
+
+// indexEntry locates an archive entry: the byte range of the archive holding its tar headers (including
+// any PAX or GNU long name header) and its content padded to the tar block size. For compressed archives
+// the range is an independently compressed gzip member, which can hold several entries.
+type indexEntry struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// archiveIndex is the random-access index stored alongside a cache archive, listing its entries in archive order.
+type archiveIndex struct {
+	Entries []indexEntry `json:"entries"`
+}
+
+// byteRange is a part of the archive to download.
+type byteRange struct {
+	offset int64
+	length int64
+}
+
+// parseIndex parses the archive index.
+func parseIndex(b []byte) (archiveIndex, error) {
+	var index archiveIndex
+	if err := json.Unmarshal(b, &index); err != nil {
+		return archiveIndex{}, err
+	}
+	for _, entry := range index.Entries {
+		if entry.Offset < 0 || entry.Length <= 0 {
+			return archiveIndex{}, fmt.Errorf("invalid range of entry %s: %d+%d", entry.Name, entry.Offset, entry.Length)
+		}
+	}
+	return index, nil
+}
+
+// fetchIndex downloads the archive index. It returns errIndexNotFound if there is no index at the given URL.
+func fetchIndex(url string) (archiveIndex, error) {
+	if url == "" {
+		return archiveIndex{}, errIndexNotFound
+	}
+
+	body, err := openPart(url)
+	if err != nil {
+		if errors.Is(err, errPartNotFound) {
+			return archiveIndex{}, errIndexNotFound
+		}
+		return archiveIndex{}, err
+	}
+	defer func() {
+		if err := body.Close(); err != nil {
+			log.Warnf("Failed to close archive index: %s", err)
+		}
+	}()
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return archiveIndex{}, err
+	}
+	return parseIndex(b)
+}
+
+// ranges returns the merged byte ranges holding the entries selected by the filter, in archive order,
+// and the total size of the archive's entries. The first entry is always included, as it holds the archive info.
+func (idx archiveIndex) ranges(filter includeFilter) ([]byteRange, int64) {
+	var total int64
+	var selected []byteRange
+	seen := map[byteRange]bool{}
+	isSelected := map[byteRange]bool{}
+	for i, entry := range idx.Entries {
+		r := byteRange{offset: entry.Offset, length: entry.Length}
+		if !seen[r] {
+			seen[r] = true
+			total += r.length
+		}
+		if !isSelected[r] && (i == 0 || filter.match(entry.Name)) {
+			isSelected[r] = true
+			selected = append(selected, r)
+		}
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].offset < selected[j].offset
+	})
+
+	var merged []byteRange
+	for _, r := range selected {
+		if n := len(merged); n > 0 && merged[n-1].offset+merged[n-1].length >= r.offset {
+			if end := r.offset + r.length; end > merged[n-1].offset+merged[n-1].length {
+				merged[n-1].length = end - merged[n-1].offset
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged, total
+}
+
+// rangeReader reads the given byte ranges of an archive one after the other, as a single stream.
+// For a compressed archive the ranges are gzip members, which are read as a multi-member gzip stream.
+type rangeReader struct {
+	url     string
+	ranges  []byteRange
+	size    int64
+	current io.ReadCloser
+}
+
+// newRangeReader opens the first range right away, so an error (e.g. no range request support) is returned early.
+func newRangeReader(url string, ranges []byteRange) (*rangeReader, error) {
+	r := &rangeReader{url: url, ranges: ranges}
+	for _, rng := range ranges {
+		r.size += rng.length
+	}
+	if err := r.advance(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Read implements the io.Reader interface.
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for r.current != nil {
+		n, err := r.current.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if err := r.advance(); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return 0, io.EOF
+}
+
+// Close closes the range being read.
+func (r *rangeReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
+
+func (r *rangeReader) advance() error {
+	if err := r.Close(); err != nil {
+		return err
+	}
+	if len(r.ranges) == 0 {
+		return nil
+	}
+
+	next := r.ranges[0]
+	r.ranges = r.ranges[1:]
+
+	body, err := openRange(r.url, next)
+	if err != nil {
+		return fmt.Errorf("failed to download archive range %d+%d: %s", next.offset, next.length, err)
+	}
+	r.current = body
+	return nil
+}
+
+// openRange opens a byte range of a local or remote archive.
+func openRange(url string, r byteRange) (io.ReadCloser, error) {
+	if !strings.HasPrefix(url, "file://") {
+		return performRangeRequest(url, r.offset, r.length)
+	}
+
+	f, err := os.Open(strings.TrimPrefix(url, "file://"))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(r.offset, io.SeekStart); err != nil {
+		if cErr := f.Close(); cErr != nil {
+			log.Warnf("Failed to close %s: %s", url, cErr)
+		}
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, r.length), f}, nil
+}
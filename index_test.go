@@ -0,0 +1,131 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// createIndexedTestArchive writes an archive with one tar entry per range, gzip compressing each range independently if compressed.
+func createIndexedTestArchive(t *testing.T, pth string, files map[string]string, order []string, compressed bool) archiveIndex {
+	var archive bytes.Buffer
+	var index archiveIndex
+	for _, name := range order {
+		var entry bytes.Buffer
+		tw := tar.NewWriter(&entry)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[name]))}); err != nil {
+			t.Fatalf("failed to write header: %s", err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatalf("failed to write content: %s", err)
+		}
+		if err := tw.Flush(); err != nil {
+			t.Fatalf("failed to flush entry: %s", err)
+		}
+
+		b := entry.Bytes()
+		if compressed {
+			var member bytes.Buffer
+			gw := gzip.NewWriter(&member)
+			if _, err := gw.Write(b); err != nil {
+				t.Fatalf("failed to compress entry: %s", err)
+			}
+			if err := gw.Close(); err != nil {
+				t.Fatalf("failed to close gzip member: %s", err)
+			}
+			b = member.Bytes()
+		}
+
+		index.Entries = append(index.Entries, indexEntry{Name: name, Offset: int64(archive.Len()), Length: int64(len(b))})
+		archive.Write(b)
+	}
+
+	if err := ioutil.WriteFile(pth, archive.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+	return index
+}
+
+func TestRangeReader(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		t.Logf("compressed: %v", compressed)
+
+		dir := t.TempDir()
+		files := map[string]string{
+			filepath.Join(dir, "archive_info.json"): "{}",
+			filepath.Join(dir, "gradle/caches/a"):   "a",
+			filepath.Join(dir, "pods/b"):            "b",
+			filepath.Join(dir, "gradle/wrapper/c"):  "c",
+		}
+		order := []string{
+			filepath.Join(dir, "archive_info.json"),
+			filepath.Join(dir, "gradle/caches/a"),
+			filepath.Join(dir, "pods/b"),
+			filepath.Join(dir, "gradle/wrapper/c"),
+		}
+
+		archive := filepath.Join(t.TempDir(), "cache.tar")
+		index := createIndexedTestArchive(t, archive, files, order, compressed)
+
+		include := includeFilter{filepath.Join(dir, "gradle")}
+		ranges, total := index.ranges(include)
+		if len(ranges) != 2 {
+			t.Fatalf("ranges() = %v, want the archive info and the two gradle entries in two ranges", ranges)
+		}
+		if ranges[0].offset != 0 || ranges[0].length != index.Entries[0].Length+index.Entries[1].Length {
+			t.Errorf("ranges() first range = %v, want the adjacent first two entries merged", ranges[0])
+		}
+		if info, err := os.Stat(archive); err != nil || info.Size() != total {
+			t.Errorf("ranges() total = %d, want the archive size", total)
+		}
+
+		r, err := newRangeReader("file://"+archive, ranges)
+		if err != nil {
+			t.Fatalf("newRangeReader() error = %v", err)
+		}
+
+		e := newExtractor(extractOptions{Compressed: compressed, Include: include}, &restoreReport{})
+		if err := e.extract(r); err != nil {
+			t.Fatalf("extract() error = %v", err)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+
+		for _, name := range []string{"gradle/caches/a", "gradle/wrapper/c"} {
+			if got := readTestFile(t, filepath.Join(dir, name)); got != files[filepath.Join(dir, name)] {
+				t.Errorf("%s content = %s, want %s", name, got, files[filepath.Join(dir, name)])
+			}
+		}
+		for _, name := range []string{"pods", "archive_info.json"} {
+			if _, err := os.Lstat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				t.Errorf("%s should not be restored, Lstat() error = %v", name, err)
+			}
+		}
+	}
+}
+
+func Test_includeFilter_match(t *testing.T) {
+	filter := includeFilter{"/home/user/.gradle", "/home/user/Library/*/Pods"}
+
+	tests := map[string]bool{
+		"/home/user/.gradle":                       true,
+		"/home/user/.gradle/caches/a.jar":          true,
+		"home/user/.gradle/caches/a.jar":           false,
+		"/home/user/.gradle-other":                 false,
+		"/home/user/Library/Caches/Pods/b":         true,
+		"/home/user/Library/Caches/CocoaPods/spec": false,
+	}
+	for name, want := range tests {
+		if got := filter.match(name); got != want {
+			t.Errorf("match(%s) = %v, want %v", name, got, want)
+		}
+	}
+	if !(includeFilter{}).match("/anything") {
+		t.Errorf("empty filter should match every entry")
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// whiteoutBackupPrefix is the name prefix of directories removed by a whiteout, kept until the journal is discarded.
+const whiteoutBackupPrefix = ".cache-pull-whiteout-"
+
+var errJournalAborted = errors.New("extraction aborted")
+
+// journalChange is a single filesystem change made by the extractor.
+// If backup is empty, the path did not exist before the extraction.
+type journalChange struct {
+	target string
+	backup string
+}
+
+// journal records every path the extractor creates or overwrites, backing up overwritten files,
+// so a failed extraction can be undone.
+type journal struct {
+	// writes is held for reading while a recorded path is written, and for writing by abort
+	writes  sync.RWMutex
+	mu      sync.Mutex
+	dir     string
+	changes []journalChange
+	seen    map[string]bool
+	aborted bool
+
+	dirBackups []string
+}
+
+func newJournal() *journal {
+	return &journal{seen: map[string]bool{}}
+}
+
+// record saves the current state of target before the extractor writes it.
+// It is a no-op on a nil journal.
+func (j *journal) record(target string) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.recordLocked(target, "")
+}
+
+// replace records target before a rename replaces it. An existing file is backed up by hard linking it to backup,
+// which should be on the target's filesystem, so the target is replaced atomically instead of being moved away first.
+// It is a no-op on a nil journal.
+func (j *journal) replace(target, backup string) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.recordLocked(target, backup)
+}
+
+// recordLocked records target, backing up an existing file with a hard link to linkBackup if it is not empty,
+// otherwise by moving it into the backup dir.
+func (j *journal) recordLocked(target, linkBackup string) error {
+	if j.aborted {
+		return errJournalAborted
+	}
+	if j.seen[target] {
+		return nil
+	}
+
+	// parent directories created by the extraction, outermost first
+	var created []string
+	for dir := filepath.Dir(target); ; {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		created = append([]string{dir}, created...)
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	for _, dir := range created {
+		j.add(journalChange{target: dir})
+	}
+
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		j.add(journalChange{target: target})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		// existing directories are merged, not replaced
+		j.seen[target] = true
+		return nil
+	}
+
+	if linkBackup != "" && info.Mode().IsRegular() {
+		if err := os.Link(target, linkBackup); err == nil {
+			j.add(journalChange{target: target, backup: linkBackup})
+			return nil
+		}
+		log.Debugf("Failed to hard link %s for backup, moving it instead", target)
+	}
+	return j.backup(target)
+}
+
+// adoptDir makes the journal remove dir once it is discarded or rolled back, as it holds backups.
+func (j *journal) adoptDir(dir string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.dirBackups = append(j.dirBackups, dir)
+}
+
+// remove deletes target, which can be a directory, backing it up first.
+// On a nil journal the target is simply removed.
+func (j *journal) remove(target string) error {
+	if j == nil {
+		return os.RemoveAll(target)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.aborted {
+		return errJournalAborted
+	}
+
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		if j.seen[target] {
+			// written by this extraction, the previous state is already recorded
+			return os.Remove(target)
+		}
+		return j.backup(target)
+	}
+
+	// directories are moved aside next to themselves, so the rename stays on the same filesystem
+	backup := filepath.Join(filepath.Dir(target), whiteoutBackupPrefix+strconv.Itoa(len(j.changes)))
+	if err := os.Rename(target, backup); err != nil {
+		return fmt.Errorf("failed to back up %s: %s", target, err)
+	}
+	j.add(journalChange{target: target, backup: backup})
+	j.dirBackups = append(j.dirBackups, backup)
+	return nil
+}
+
+// backup moves the existing file at target into the backup dir.
+func (j *journal) backup(target string) error {
+	if j.dir == "" {
+		var err error
+		j.dir, err = ioutil.TempDir("", "cache-pull-backup-")
+		if err != nil {
+			return fmt.Errorf("failed to create backup dir: %s", err)
+		}
+	}
+
+	backup := filepath.Join(j.dir, strconv.Itoa(len(j.changes)))
+	if err := moveFile(target, backup); err != nil {
+		return fmt.Errorf("failed to back up %s: %s", target, err)
+	}
+	j.add(journalChange{target: target, backup: backup})
+	return nil
+}
+
+func (j *journal) add(change journalChange) {
+	j.changes = append(j.changes, change)
+	j.seen[change.target] = true
+}
+
+// rollback undoes the recorded changes, restoring the backed up files, and clears the journal.
+func (j *journal) rollback() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.undo()
+}
+
+// begin marks the start of writing a recorded path, the returned function marks its end.
+// It is a no-op on a nil journal.
+func (j *journal) begin() func() {
+	if j == nil {
+		return func() {}
+	}
+
+	j.writes.RLock()
+	return j.writes.RUnlock
+}
+
+// abort rolls back the recorded changes and makes every later record call fail,
+// so an extraction running concurrently cannot write anything after the rollback.
+// It waits for the writes in progress, and blocks the later ones for good, as the step exits after an abort.
+func (j *journal) abort() error {
+	j.writes.Lock()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.aborted = true
+	return j.undo()
+}
+
+// discard drops the journal and its backups after a successful extraction.
+func (j *journal) discard() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.changes = nil
+	j.seen = map[string]bool{}
+	j.removeBackups()
+}
+
+func (j *journal) undo() error {
+	log.Debugf("Rolling back %d change(s)", len(j.changes))
+
+	var failed int
+	for i := len(j.changes) - 1; i >= 0; i-- {
+		change := j.changes[i]
+		if err := os.Remove(change.target); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Failed to remove %s: %s", change.target, err)
+			failed++
+			continue
+		}
+		if change.backup == "" {
+			continue
+		}
+		if err := moveFile(change.backup, change.target); err != nil {
+			log.Warnf("Failed to restore %s: %s", change.target, err)
+			failed++
+		}
+	}
+
+	j.changes = nil
+	j.seen = map[string]bool{}
+	if failed > 0 {
+		dirs := j.dirBackups
+		if j.dir != "" {
+			dirs = append(dirs, j.dir)
+		}
+		return fmt.Errorf("failed to roll back %d path(s), backups are kept in %s", failed, strings.Join(dirs, ", "))
+	}
+
+	j.removeBackups()
+	return nil
+}
+
+func (j *journal) removeBackups() {
+	for _, backup := range j.dirBackups {
+		if err := os.RemoveAll(backup); err != nil {
+			log.Warnf("Failed to remove backup %s: %s", backup, err)
+		}
+	}
+	j.dirBackups = nil
+
+	if j.dir == "" {
+		return
+	}
+	if err := os.RemoveAll(j.dir); err != nil {
+		log.Warnf("Failed to remove backup dir %s: %s", j.dir, err)
+	}
+	j.dir = ""
+}
+
+// moveFile moves a file or symlink, falling back to copying when a rename is not possible (e.g. across devices).
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(link, dst); err != nil {
+			return err
+		}
+		return os.Remove(src)
+	}
+
+	if !info.Mode().IsRegular() {
+		// reading a fifo would block, device nodes are not copied by their content
+		return fmt.Errorf("%s is a special file, it can not be moved across devices", src)
+	}
+	if err := copyFile(src, dst, info); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src, dst string, info os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := in.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", src, err)
+		}
+	}()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		if cErr := out.Close(); cErr != nil {
+			log.Warnf("Failed to close %s: %s", dst, cErr)
+		}
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournal_abortWaitsForWrites(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "file.txt")
+
+	j := newJournal()
+	if err := j.record(target); err != nil {
+		t.Fatalf("record() error = %v", err)
+	}
+
+	done := j.begin()
+	aborted := make(chan error)
+	go func() {
+		aborted <- j.abort()
+	}()
+
+	select {
+	case err := <-aborted:
+		t.Fatalf("abort() returned while a write is in progress, error = %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := ioutil.WriteFile(target, []byte("written"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	done()
+
+	if err := <-aborted; err != nil {
+		t.Fatalf("abort() error = %v", err)
+	}
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		t.Errorf("file written before the abort should be removed, Lstat() error = %v", err)
+	}
+	if err := j.record(target); err != errJournalAborted {
+		t.Errorf("record() after abort error = %v, want %v", err, errJournalAborted)
+	}
+}
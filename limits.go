@@ -0,0 +1,62 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"strings"
+
+	"github.com/docker/go-units"
+)
+
+// extractLimits caps what a cache archive can contain, 0 means no limit.
+type extractLimits struct {
+	MaxTotalSize int64
+	MaxFileSize  int64
+	MaxEntries   int
+}
+
+// limitError is returned when the archive exceeds one of the extract limits.
+type limitError struct {
+	Reason string
+}
+
+func (e limitError) Error() string {
+	return "cache archive exceeds the limits: " + e.Reason
+}
+
+// parseSizeLimit parses a size like 500MB or 10GB, an empty value or 0 means no limit.
+func parseSizeLimit(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+
+	size, err := units.FromHumanSize(s)
+	if err != nil {
+		return 0, err
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("negative size: %s", s)
+	}
+	return size, nil
+}
+
+// check is called with each entry's header before the entry is read,
+// together with the number of entries and their total size so far, including this entry.
+func (l extractLimits) check(hdr *tar.Header, entries int, total int64) error {
+	if l.MaxEntries > 0 && entries > l.MaxEntries {
+		return limitError{Reason: fmt.Sprintf("more than %d entries", l.MaxEntries)}
+	}
+	if l.MaxFileSize > 0 && hdr.Size > l.MaxFileSize {
+		return limitError{Reason: fmt.Sprintf("%s is %s, larger than the maximum file size (%s)",
+			hdr.Name, humanSize(hdr.Size), humanSize(l.MaxFileSize))}
+	}
+	if l.MaxTotalSize > 0 && total > l.MaxTotalSize {
+		return limitError{Reason: fmt.Sprintf("the uncompressed size is over %s at %s", humanSize(l.MaxTotalSize), hdr.Name)}
+	}
+	return nil
+}
+
+func humanSize(size int64) string {
+	return units.HumanSizeWithPrecision(float64(size), 3)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+const listingFileName = "cache-pull-listing.txt"
+
+// listingFileNameOf returns the listing file name of a cache layer, the base layer of the unnamed cache uses the default name.
+func listingFileNameOf(name string, layer int) string {
+	base := strings.TrimSuffix(listingFileName, ".txt")
+	if name != "" {
+		base += "-" + name
+	}
+	if layer > 0 {
+		base += fmt.Sprintf("-layer-%d", layer)
+	}
+	return base + ".txt"
+}
+
+// listedEntry is an archive entry as shown in dry-run mode.
+type listedEntry struct {
+	Path    string
+	Size    int64
+	Type    string
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// dirSummary is the total size of the entries under a top-level directory.
+type dirSummary struct {
+	Dir     string
+	Size    int64
+	Entries int
+}
+
+// listCacheArchive reads the archive streamed by r and returns its entries without writing anything to disk.
+func listCacheArchive(r io.Reader, compressed bool) ([]listedEntry, error) {
+	var entries []listedEntry
+	err := walkArchive(r, compressed, func(_ io.Reader, hdr *tar.Header) error {
+		entries = append(entries, listedEntry{
+			Path:    hdr.Name,
+			Size:    hdr.Size,
+			Type:    entryType(hdr.Typeflag),
+			Mode:    hdr.FileInfo().Mode().Perm(),
+			ModTime: hdr.ModTime,
+		})
+		return nil
+	})
+	return entries, err
+}
+
+func entryType(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeGNUSparse:
+		return "sparse file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeFifo:
+		return "fifo"
+	case tar.TypeChar, tar.TypeBlock:
+		return "device"
+	default:
+		return fmt.Sprintf("other (%c)", typeflag)
+	}
+}
+
+// summarizeListing sums the entry sizes per top-level directory, largest first.
+// Paths under the home directory are grouped by their first component relative to it (e.g. ~/.gradle).
+func summarizeListing(entries []listedEntry, home string) []dirSummary {
+	sizes := map[string]*dirSummary{}
+	for _, entry := range entries {
+		dir := topLevelDir(entry.Path, home)
+		summary, ok := sizes[dir]
+		if !ok {
+			summary = &dirSummary{Dir: dir}
+			sizes[dir] = summary
+		}
+		summary.Size += entry.Size
+		summary.Entries++
+	}
+
+	var summaries []dirSummary
+	for _, summary := range sizes {
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Size != summaries[j].Size {
+			return summaries[i].Size > summaries[j].Size
+		}
+		return summaries[i].Dir < summaries[j].Dir
+	})
+	return summaries
+}
+
+func topLevelDir(name, home string) string {
+	pth := filepath.Clean(filepath.FromSlash(name))
+
+	prefix := ""
+	if home != "" && strings.HasPrefix(pth, home+string(filepath.Separator)) {
+		prefix = "~" + string(filepath.Separator)
+		pth = strings.TrimPrefix(pth, home+string(filepath.Separator))
+	} else if filepath.IsAbs(pth) {
+		prefix = string(filepath.Separator)
+		pth = strings.TrimPrefix(pth, string(filepath.Separator))
+	}
+
+	return prefix + strings.SplitN(pth, string(filepath.Separator), 2)[0]
+}
+
+// writeListing writes the per directory summary and the entries as aligned text.
+func writeListing(w io.Writer, entries []listedEntry, summaries []dirSummary) error {
+	var b strings.Builder
+
+	fmt.Fprintln(&b, "SIZE\tENTRIES\tDIRECTORY")
+	for _, summary := range summaries {
+		fmt.Fprintf(&b, "%s\t%d\t%s\n", units.HumanSizeWithPrecision(float64(summary.Size), 3), summary.Entries, summary.Dir)
+	}
+	fmt.Fprintln(&b)
+
+	fmt.Fprintln(&b, "TYPE\tMODE\tSIZE\tMODIFIED\tPATH")
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "%s\t%s\t%d\t%s\t%s\n", entry.Type, entry.Mode, entry.Size, entry.ModTime.UTC().Format(time.RFC3339), entry.Path)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if _, err := io.WriteString(tw, b.String()); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_summarizeListing(t *testing.T) {
+	entries := []listedEntry{
+		{Path: "/Users/vagrant/.gradle/caches/a.jar", Size: 10},
+		{Path: "/Users/vagrant/.gradle/wrapper/b.zip", Size: 20},
+		{Path: "/Users/vagrant/.cocoapods/repos/c", Size: 5},
+		{Path: "/tmp/archive_info.json", Size: 1},
+		{Path: "node_modules/d.js", Size: 40},
+	}
+
+	want := []dirSummary{
+		{Dir: "node_modules", Size: 40, Entries: 1},
+		{Dir: "~/.gradle", Size: 30, Entries: 2},
+		{Dir: "~/.cocoapods", Size: 5, Entries: 1},
+		{Dir: "/tmp", Size: 1, Entries: 1},
+	}
+	if got := summarizeListing(entries, "/Users/vagrant"); !reflect.DeepEqual(got, want) {
+		t.Errorf("summarizeListing() = %v, want %v", got, want)
+	}
+}
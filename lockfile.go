@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// lockfile is the checksum of a key file (e.g. Podfile.lock) the cached paths were built from.
+type lockfile struct {
+	// Path is relative to the working directory, or absolute.
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	// Paths are the cached paths depending on the lockfile, the whole cache depends on it if empty.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// lockfileInfo is the list of lockfile checksums the cache push step can store in the archive info.
+type lockfileInfo struct {
+	Lockfiles []lockfile `json:"lockfiles,omitempty"`
+}
+
+// changedLockfile is a lockfile whose checksum in the current checkout differs from the archive's.
+type changedLockfile struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected_sha256"`
+	// Actual is empty if the lockfile does not exist in the current checkout.
+	Actual        string   `json:"actual_sha256,omitempty"`
+	ExcludedPaths []string `json:"excluded_paths,omitempty"`
+}
+
+// checkLockfiles recomputes the checksums of the archive's lockfiles in the working directory,
+// and returns the changed ones and the cached paths depending on them.
+// It returns false if a lockfile the whole cache depends on has changed.
+func checkLockfiles(archiveInfo []byte, workDir, cacheName string) ([]changedLockfile, includeFilter, bool) {
+	if archiveInfo == nil {
+		return nil, nil, true
+	}
+
+	var info lockfileInfo
+	if err := json.Unmarshal(archiveInfo, &info); err != nil {
+		log.Debugf("Failed to parse archive lockfiles: %s", err)
+		return nil, nil, true
+	}
+	if len(info.Lockfiles) == 0 {
+		return nil, nil, true
+	}
+
+	logSection(cacheName, "Checking lockfiles")
+
+	var changed []changedLockfile
+	var excluded includeFilter
+	ok := true
+	for _, lock := range info.Lockfiles {
+		pth := lock.Path
+		if !filepath.IsAbs(pth) {
+			pth = filepath.Join(workDir, pth)
+		}
+
+		actual, err := lockfileChecksum(pth)
+		if err != nil && !os.IsNotExist(err) {
+			log.Warnf("Failed to compute the checksum of %s: %s", lock.Path, err)
+		}
+		if strings.EqualFold(actual, lock.SHA256) {
+			log.Printf("%s: unchanged", lock.Path)
+			continue
+		}
+
+		change := changedLockfile{Path: lock.Path, Expected: lock.SHA256, Actual: actual}
+		for _, p := range lock.Paths {
+			change.ExcludedPaths = append(change.ExcludedPaths, filepath.Clean(p))
+		}
+		changed = append(changed, change)
+
+		switch {
+		case actual == "":
+			log.Warnf("%s: missing from the current checkout", lock.Path)
+		default:
+			log.Warnf("%s: changed since the cache was created", lock.Path)
+		}
+
+		if len(change.ExcludedPaths) == 0 {
+			ok = false
+		}
+		excluded = append(excluded, change.ExcludedPaths...)
+	}
+	return changed, excluded, ok
+}
+
+// lockfileChecksum returns the hex encoded SHA-256 checksum of the file.
+func lockfileChecksum(pth string) (string, error) {
+	h := sha256.New()
+	if err := hashFile(h, pth); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
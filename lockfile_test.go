@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_checkLockfiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "Podfile.lock"), []byte("pods"), 0644); err != nil {
+		t.Fatalf("failed to write lockfile: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "yarn.lock"), []byte("yarn"), 0644); err != nil {
+		t.Fatalf("failed to write lockfile: %s", err)
+	}
+	podsSum, err := lockfileChecksum(filepath.Join(dir, "Podfile.lock"))
+	if err != nil {
+		t.Fatalf("lockfileChecksum() error = %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		archiveInfo  string
+		wantChanged  []string
+		wantExcluded includeFilter
+		wantOK       bool
+	}{
+		{
+			name:        "unchanged",
+			archiveInfo: `{"lockfiles": [{"path": "Podfile.lock", "sha256": "` + podsSum + `"}]}`,
+			wantOK:      true,
+		},
+		{
+			name:         "changed with dependent paths",
+			archiveInfo:  `{"lockfiles": [{"path": "Podfile.lock", "sha256": "` + podsSum + `"}, {"path": "yarn.lock", "sha256": "00", "paths": ["/src/node_modules"]}]}`,
+			wantChanged:  []string{"yarn.lock"},
+			wantExcluded: includeFilter{"/src/node_modules"},
+			wantOK:       true,
+		},
+		{
+			name:        "missing",
+			archiveInfo: `{"lockfiles": [{"path": "Gemfile.lock", "sha256": "00"}]}`,
+			wantChanged: []string{"Gemfile.lock"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed, excluded, ok := checkLockfiles([]byte(tt.archiveInfo), dir, "")
+
+			var names []string
+			for _, c := range changed {
+				names = append(names, c.Path)
+			}
+			if !reflect.DeepEqual(names, tt.wantChanged) || !reflect.DeepEqual(excluded, tt.wantExcluded) || ok != tt.wantOK {
+				t.Errorf("checkLockfiles() = %v, %v, %v, want %v, %v, %v", names, excluded, ok, tt.wantChanged, tt.wantExcluded, tt.wantOK)
+			}
+		})
+	}
+}
@@ -1,21 +1,24 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/bitrise-io/go-steputils/stepconf"
 	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
 	"github.com/bitrise-steplib/steps-cache-push/model"
 	"github.com/docker/go-units"
 )
@@ -30,176 +33,287 @@ const (
 
 // Config stores the step inputs.
 type Config struct {
-	CacheAPIURL           string `env:"cache_api_url"`
-	DebugMode             bool   `env:"is_debug_mode,opt[true,false]"`
-	AllowFallback         bool   `env:"allow_fallback,opt[true,false]"`
-	ExtractToRelativePath bool   `env:"extract_to_relative_path,opt[true,false]"`
-	IgnoreStackDifference bool   `env:"ignore_stack_difference,opt[true,false]"`
-
-	StackID   string `env:"BITRISEIO_STACK_ID"`
-	BuildSlug string `env:"BITRISE_BUILD_SLUG"`
+	WorkDir               string          `env:"workdir"`
+	CacheAPIURL           string          `env:"cache_api_url"`
+	Caches                string          `env:"caches"`
+	CacheKey              string          `env:"cache_key"`
+	RestoreKeys           string          `env:"restore_keys"`
+	CacheBackendURL       string          `env:"cache_backend_url"`
+	DefaultBranch         string          `env:"default_branch"`
+	BranchCacheURL        string          `env:"branch_cache_url"`
+	ArchiveParts          string          `env:"archive_parts"`
+	CacheLayers           string          `env:"cache_layers"`
+	EncryptionKey         stepconf.Secret `env:"encryption_key"`
+	SignatureVerification string          `env:"signature_verification,opt[off,warn,fail]"`
+	SignaturePublicKey    string          `env:"signature_public_key"`
+	SignatureURL          string          `env:"signature_url"`
+	IncludePaths          string          `env:"include_paths"`
+	AllowedPaths          string          `env:"allowed_paths"`
+	DeniedPaths           string          `env:"denied_paths"`
+	IndexURL              string          `env:"index_url"`
+	ArchiveInfoURL        string          `env:"archive_info_url"`
+	DiskSpaceCheck        bool            `env:"disk_space_check,opt[true,false]"`
+	MaxUncompressedSize   string          `env:"max_uncompressed_size"`
+	MaxFileSize           string          `env:"max_file_size"`
+	MaxEntries            int             `env:"max_entries,range[0..2147483647]"`
+	DebugMode             bool            `env:"is_debug_mode,opt[true,false]"`
+	AllowFallback         bool            `env:"allow_fallback,opt[true,false]"`
+	ExtractToRelativePath bool            `env:"extract_to_relative_path,opt[true,false]"`
+	IgnoreStackDifference bool            `env:"ignore_stack_difference,opt[true,false]"`
+	StackRules            string          `env:"stack_rules"`
+	StackRulesPath        string          `env:"stack_rules_path"`
+	ArchitectureRules     string          `env:"architecture_rules"`
+	PortablePaths         string          `env:"portable_paths"`
+	LockfileCheck         bool            `env:"lockfile_check,opt[true,false]"`
+	ToolchainPolicies     string          `env:"toolchain_policies"`
+	ToolchainFingerprints string          `env:"toolchain_fingerprints"`
+	OnConflict            string          `env:"on_conflict,opt[overwrite,skip-existing,keep-newer,fail]"`
+	AtomicRestore         bool            `env:"atomic_restore,opt[true,false]"`
+	RollbackOnFailure     bool            `env:"rollback_on_failure,opt[true,false]"`
+	ManifestVerification  string          `env:"manifest_verification,opt[off,warn,fail]"`
+	ManifestSampleRate    float64         `env:"manifest_sample_rate,range[0.0..1.0]"`
+	DryRun                bool            `env:"dry_run,opt[true,false]"`
+	ExtractWorkers        int             `env:"extract_workers,range[0..1024]"`
+	PunchHoles            bool            `env:"punch_holes,opt[true,false]"`
+	RestoreReport         bool            `env:"restore_report,opt[true,false]"`
+
+	StackID        string `env:"BITRISEIO_STACK_ID"`
+	Branch         string `env:"BITRISE_GIT_BRANCH"`
+	PRTargetBranch string `env:"BITRISEIO_GIT_BRANCH_DEST"`
+	Workflow       string `env:"BITRISE_TRIGGERED_WORKFLOW_ID"`
+	BuildSlug      string `env:"BITRISE_BUILD_SLUG"`
+	DeployDir      string `env:"BITRISE_DEPLOY_DIR"`
 }
 
 func main() {
-	// Possible values of GOARCH: https://go.dev/doc/install/source#environment
-	const currentArchitecture = runtime.GOARCH
-
 	var conf Config
 	if err := stepconf.Parse(&conf); err != nil {
 		failf(err.Error())
 	}
 
 	stepconf.Print(conf)
-	log.Printf("- architecture: %s", currentArchitecture)
 	log.SetEnableDebugLog(conf.DebugMode)
+	currentArchitecture := detectHostArchitecture()
+	log.Printf("- architecture: %s", currentArchitecture)
 
-	if conf.CacheAPIURL == "" {
-		log.Warnf("No Cache API URL specified, there's no cache to use, exiting.")
-		return
+	if conf.Caches != "" {
+		caches, err := parseNamedCaches(conf.Caches)
+		if err != nil {
+			failf("Invalid caches: %s", err)
+		}
+		if !restoreNamedCaches(conf, caches, currentArchitecture) {
+			return
+		}
+	} else {
+		outputs := &stepOutputs{}
+		result, err := restoreCache(conf, currentArchitecture, "", outputs)
+		outputs.export()
+		if err != nil {
+			failf("Failed to restore the cache: %s", err)
+		}
+		if result != archiveRestored && result != archiveSkipped {
+			return
+		}
 	}
 
-	downloadStartTime := time.Now()
-
-	var cacheReader io.Reader
-	var cacheURI string
-
-	if strings.HasPrefix(conf.CacheAPIURL, "file://") {
-		cacheURI = conf.CacheAPIURL
+	if err := writeCachePullTimestamp(); err != nil {
+		failf("Couldn't save cache pull timestamp: %s", err)
+	}
+}
 
+// restoreCache restores a cache, with all of its layers. The name of a named cache is used in its outputs and files.
+// Its step outputs are recorded in outputs, to be exported by the caller.
+func restoreCache(conf Config, currentArchitecture, name string, outputs *stepOutputs) (pullResult, error) {
+	if name != "" {
 		fmt.Println()
-		log.Infof("Using local cache archive")
+		log.Infof("Cache %s", name)
+	}
 
-		pth := strings.TrimPrefix(conf.CacheAPIURL, "file://")
+	sources := cacheSources(conf)
+	if conf.CacheKey != "" {
+		if conf.CacheBackendURL == "" {
+			return archiveNotFound, errors.New("cache backend URL is required to look up the cache key")
+		}
 
-		var err error
-		cacheReader, err = os.Open(pth)
+		logSection(name, "Looking up the cache key")
+		entry, hit, err := resolveCacheKey(conf, currentArchitecture)
 		if err != nil {
-			failf("Failed to open cache archive file: %s", err)
+			return archiveNotFound, fmt.Errorf("cache key lookup failed: %s", err)
 		}
-	} else {
-		fmt.Println()
-		log.Infof("Downloading remote cache archive")
-
-		var err error
-		if isBitriseCacheAPIURL(conf.CacheAPIURL) {
-			cacheURI, err = getCacheDownloadURL(conf.CacheAPIURL)
-			if err != nil {
-				if errors.Is(err, errNoCache) {
-					log.Donef("No saved cache found")
-					os.Exit(0)
-				}
-				failf("Failed to get cache download URL: %s", err)
-			}
-		} else {
-			cacheURI = conf.CacheAPIURL
+
+		matchedKey := ""
+		if entry != nil {
+			matchedKey = entry.Key
+			log.Printf("matched key: %s (%s hit)", matchedKey, hit)
+		}
+		if !conf.DryRun {
+			outputs.setCacheHit(hit, matchedKey, name)
 		}
 
-		cacheReader, err = performRequest(cacheURI)
-		if err != nil {
-			failf("Failed to perform cache download request: %s", err)
+		if entry == nil {
+			log.Donef("No cache entry found for the cache key")
+			return archiveNotFound, nil
 		}
+		sources = []cacheSource{{URL: entry.DownloadURL}}
+	}
+	if len(sources) == 0 {
+		log.Warnf("No Cache API URL specified, there's no cache to use, exiting.")
+		return archiveNotFound, nil
 	}
 
-	log.Printf("Archive downloaded in %s", time.Since(downloadStartTime).Round(time.Second))
-
-	restoreStartTime := time.Now()
-	cacheRecorderReader := NewRestoreReader(cacheReader)
-
-	r, hdr, compressed, err := readFirstEntry(cacheRecorderReader)
+	key, err := parseEncryptionKey(string(conf.EncryptionKey))
 	if err != nil {
-		failf("Failed to get first archive entry: %s", err)
+		return archiveNotFound, fmt.Errorf("invalid encryption key: %s", err)
 	}
 
-	cacheRecorderReader.Restore()
+	var publicKey ed25519.PublicKey
+	if conf.SignatureVerification != "off" {
+		if publicKey, err = parsePublicKey(conf.SignaturePublicKey); err != nil {
+			return archiveNotFound, fmt.Errorf("invalid signature public key: %s", err)
+		}
+	}
 
 	currentStackInfo := model.ArchiveInfo{
 		StackID:      strings.TrimSpace(conf.StackID),
 		Architecture: currentArchitecture,
 	}
-	if currentStackInfo.StackID != "" {
-		fmt.Println()
-		log.Infof("Checking archive and current stacks")
-		log.Printf("current stack: %s", currentStackInfo)
 
-		if filepath.Base(hdr.Name) == "archive_info.json" {
-			b, err := ioutil.ReadAll(r)
-			if err != nil {
-				failf("Failed to read first archive entry: %s", err)
-			}
+	rules, err := loadStackRules(conf.StackRules, conf.StackRulesPath)
+	if err != nil {
+		return archiveNotFound, fmt.Errorf("invalid stack rules: %s", err)
+	}
 
-			archiveStackInfo, err := parseArchiveInfo(b)
-			if err != nil {
-				failf("Failed to parse first archive entry: %s", err)
-			}
-			log.Printf("archive stack: %s", archiveStackInfo)
+	archRules, err := parseStackRules(conf.ArchitectureRules)
+	if err != nil {
+		return archiveNotFound, fmt.Errorf("invalid architecture rules: %s", err)
+	}
 
-			if !conf.IgnoreStackDifference && !isSameStack(archiveStackInfo, currentStackInfo) {
-				log.Warnf("Cache was created on stack: %s, current stack: %s", archiveStackInfo, currentStackInfo)
-				log.Warnf("Skipping cache pull, as the stack has changed")
+	policies, err := parseToolchainPolicies(conf.ToolchainPolicies)
+	if err != nil {
+		return archiveNotFound, fmt.Errorf("invalid toolchain policies: %s", err)
+	}
 
-				if err := writeCachePullTimestamp(); err != nil {
-					failf("Couldn't save cache pull timestamp: %s", err)
-				}
+	include := parseIncludeFilter(conf.IncludePaths)
+	paths := pathPolicy{Allow: parsePathList(conf.AllowedPaths), Deny: parsePathList(conf.DeniedPaths)}
 
-				os.Exit(0)
-			}
+	limits := extractLimits{MaxEntries: conf.MaxEntries}
+	if limits.MaxTotalSize, err = parseSizeLimit(conf.MaxUncompressedSize); err != nil {
+		return archiveNotFound, fmt.Errorf("invalid maximum uncompressed size: %s", err)
+	}
+	if limits.MaxFileSize, err = parseSizeLimit(conf.MaxFileSize); err != nil {
+		return archiveNotFound, fmt.Errorf("invalid maximum file size: %s", err)
+	}
 
-			if archiveStackInfo.Version < model.Version {
-				if archiveStackInfo.Architecture == "" {
-					log.Warnf("Cache has missing architecture info so default (amd64) architecture is assumed")
-				}
+	report := &restoreReport{Name: name}
+	ext := newExtractor(extractOptions{
+		Relative:   conf.ExtractToRelativePath,
+		OnConflict: conflictPolicy(conf.OnConflict),
+		Staged:     conf.AtomicRestore,
+		// archives exceeding the limits are rolled back
+		Rollback:   conf.RollbackOnFailure || limits != (extractLimits{}),
+		Workers:    extractWorkers(conf.ExtractWorkers),
+		PunchHoles: conf.PunchHoles,
+		Include:    include,
+		Limits:     limits,
+		Paths:      paths,
+	}, report)
+
+	if conf.RollbackOnFailure && !conf.DryRun {
+		stop := rollbackOnTermination(ext)
+		defer stop()
+	}
 
-				log.Warnf("Please update your cache-push step to the latest version")
+	p := puller{
+		name:      name,
+		conf:      conf,
+		key:       key,
+		publicKey: publicKey,
+		stack:     currentStackInfo,
+		rules:     rules,
+		archRules: archRules,
+		policies:  policies,
+		toolchain: newCurrentToolchain(parseFingerprints(conf.ToolchainFingerprints)),
+		include:   include,
+		portable:  parseIncludeFilter(conf.PortablePaths),
+		ext:       ext,
+		report:    report,
+		outputs:   outputs,
+	}
+
+	// later layers are deltas on top of the earlier ones, so the restore stops at the first missing or skipped layer
+	restored := 0
+	result := archiveRestored
+	var pullErr error
+	for _, src := range sources {
+		if len(sources) > 1 {
+			logSection(name, "Cache layer %d/%d: %s", src.Layer+1, len(sources), src)
+		}
+
+		if result, pullErr = p.pull(src); pullErr != nil {
+			break
+		}
+		if result != archiveRestored && result != archiveListed {
+			if remaining := len(sources) - src.Layer - 1; remaining > 0 {
+				log.Warnf("Skipping the remaining %d cache layer(s)", remaining)
 			}
-		} else {
-			log.Warnf("cache archive does not contain stack information, skipping stack check")
+			break
 		}
+		restored++
 	}
 
-	fmt.Println()
-	log.Infof("Extracting cache archive")
+	if conf.DryRun {
+		return archiveListed, pullErr
+	}
+	if conf.SignatureVerification != "off" {
+		outputs.setSignatureStatus(report.SignatureStatus.worse(signatureNotChecked), name)
+	}
+	if pullErr != nil {
+		return result, pullErr
+	}
+	if restored == 0 && result == archiveNotFound {
+		return archiveNotFound, nil
+	}
 
-	if err := extractCacheArchive(cacheRecorderReader, conf.ExtractToRelativePath, compressed); err != nil {
-		if !conf.AllowFallback {
-			failf("Failed to uncompress cache archive stream: %s", err)
+	if restored == 0 && len(report.ChangedLockfiles) > 0 {
+		writeReport(conf.DeployDir, report)
+	}
+	if restored > 0 {
+		if report.Branch != "" {
+			log.Printf("Restored the cache of the %s branch", report.Branch)
+			outputs.setCacheBranch(report.Branch, name)
 		}
-
-		log.Warnf("Failed to uncompress cache archive stream: %s", err)
-		log.Warnf("Downloading the archive file and trying to uncompress using tar tool")
-		data := map[string]interface{}{
-			"archive_bytes_read": cacheRecorderReader.BytesRead,
-			"build_slug":         conf.BuildSlug,
+		if report.SparseBytesSaved > 0 {
+			log.Printf("Disk space saved by sparse files: %s", units.HumanSizeWithPrecision(float64(report.SparseBytesSaved), 3))
 		}
-		log.RInfof(stepID, "cache_archive_fallback", data, "Failed to uncompress cache archive stream: %s", err)
-
-		pth, err := downloadCacheArchive(cacheURI, conf.BuildSlug)
-		if err != nil {
-			failf("Fallback failed, unable to download cache archive: %s", err)
+		if len(report.Whiteouts) > 0 {
+			log.Printf("%d path(s) removed by cache layer whiteouts", len(report.Whiteouts))
 		}
-
-		if err := uncompressArchive(pth, conf.ExtractToRelativePath, compressed); err != nil {
-			failf("Fallback failed, unable to uncompress cache archive file: %s", err)
+		if len(report.Blocked) > 0 {
+			log.Warnf("%d archive entries blocked by the allowed and denied paths, not restored", len(report.Blocked))
 		}
-	} else {
-		data := map[string]interface{}{
-			"cache_archive_size": cacheRecorderReader.BytesRead,
-			"build_slug":         conf.BuildSlug,
+		if len(report.Conflicts) > 0 {
+			log.Warnf("%d restored path(s) already existed, handled with the %s policy", len(report.Conflicts), conf.OnConflict)
 		}
-		log.Debugf("Size of extracted cache archive: %d Bytes", cacheRecorderReader.BytesRead)
-		log.RInfof(stepID, "cache_archive_size", data, "Size of extracted cache archive: %d Bytes", cacheRecorderReader.BytesRead)
+		if conf.RestoreReport || report.notable() {
+			writeReport(conf.DeployDir, report)
+		}
+		return archiveRestored, nil
 	}
+	return result, nil
+}
 
-	size := units.HumanSizeWithPrecision(float64(cacheRecorderReader.BytesRead), 3)
-	log.Printf("Cache archive size: %s", size)
-	log.Printf("Extracted archive contents in %s", time.Since(restoreStartTime).Round(time.Second))
+// Helpers
 
-	if err := writeCachePullTimestamp(); err != nil {
-		failf("Couldn't save cache pull timestamp: %s", err)
+// logSection starts a log section. The title of a named cache's section starts with the cache's name,
+// as the logs of the named caches restored concurrently are interleaved.
+func logSection(name, format string, args ...interface{}) {
+	fmt.Println()
+	if name != "" {
+		format = name + ": " + format
 	}
+	log.Infof(format, args...)
 }
 
-// Helpers
-
 // failf prints an error and terminates the step.
 func failf(format string, args ...interface{}) {
 	log.Errorf(format, args...)
@@ -212,13 +326,12 @@ func parseArchiveInfo(b []byte) (info model.ArchiveInfo, err error) {
 	return
 }
 
-func isSameStack(archiveStackInfo model.ArchiveInfo, currentStackInfo model.ArchiveInfo) bool {
-	// TODO This check is a temporary solution to support GEN2 VMs having different ids for same stack types
-	r := regexp.MustCompile("^(.+)-gen2.*$")
-	currentStackInfo.StackID = r.ReplaceAllString(currentStackInfo.StackID, "$1")
-	archiveStackInfo.StackID = r.ReplaceAllString(archiveStackInfo.StackID, "$1")
-
-	if archiveStackInfo.StackID != currentStackInfo.StackID {
+func isSameStack(archiveStackInfo model.ArchiveInfo, currentStackInfo model.ArchiveInfo, rules, archRules stackRules) bool {
+	compatible, rule := rules.compatible(archiveStackInfo.StackID, currentStackInfo.StackID)
+	if rule != "" {
+		log.Printf("stack compatibility rule: %s", rule)
+	}
+	if !compatible {
 		return false
 	}
 
@@ -226,7 +339,166 @@ func isSameStack(archiveStackInfo model.ArchiveInfo, currentStackInfo model.Arch
 		return true
 	}
 
-	return archiveStackInfo.Architecture == currentStackInfo.Architecture
+	compatible, rule = archRules.compatible(archiveStackInfo.Architecture, currentStackInfo.Architecture)
+	if rule != "" {
+		log.Printf("architecture compatibility rule: %s", rule)
+	}
+	return compatible
+}
+
+// extractWorkers returns the number of file writer goroutines, 0 means one per CPU.
+func extractWorkers(workers int) int {
+	if workers == 0 {
+		return runtime.NumCPU()
+	}
+	return workers
+}
+
+// listArchive lists the archive's entries and their size per top-level directory instead of extracting them.
+// The listing is written into the deploy dir, if there is one.
+func listArchive(r io.Reader, compressed bool, deployDir, name string, layer int) error {
+	logSection(name, "Listing cache archive (dry run)")
+
+	entries, err := listCacheArchive(r, compressed)
+	if err != nil {
+		return fmt.Errorf("failed to list cache archive: %s", err)
+	}
+
+	summaries := summarizeListing(entries, pathutil.UserHomeDir())
+	for _, summary := range summaries {
+		log.Printf("%s\t%s", units.HumanSizeWithPrecision(float64(summary.Size), 3), summary.Dir)
+	}
+	log.Printf("%d entries in the archive", len(entries))
+
+	if deployDir == "" {
+		log.Warnf("No deploy dir specified, the full listing is not saved")
+		return nil
+	}
+
+	pth := filepath.Join(deployDir, listingFileNameOf(name, layer))
+	f, err := os.Create(pth)
+	if err != nil {
+		return fmt.Errorf("failed to create listing file: %s", err)
+	}
+	if err := writeListing(f, entries, summaries); err != nil {
+		if cErr := f.Close(); cErr != nil {
+			log.Warnf("Failed to close listing file: %s", cErr)
+		}
+		return fmt.Errorf("failed to write listing file: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close listing file: %s", err)
+	}
+	log.Donef("Archive listing: %s", pth)
+	return nil
+}
+
+// verifyRestoredFiles checks the restored files against the archive manifest.
+// On mismatch the extraction is rolled back and an error is returned, if the verification is set to fail.
+func verifyRestoredFiles(e *extractor, conf Config, report *restoreReport) error {
+	logSection(report.Name, "Verifying restored files")
+
+	checked, mismatches, ok := e.verify(conf.ManifestSampleRate)
+	if !ok {
+		log.Printf("Cache archive does not contain a manifest, skipping verification")
+		return nil
+	}
+
+	report.ManifestMismatches = append(report.ManifestMismatches, mismatches...)
+	if len(mismatches) == 0 {
+		log.Donef("%d restored file(s) match the manifest", checked)
+		return nil
+	}
+
+	for _, mismatch := range mismatches {
+		log.Warnf("- %s: %s", mismatch.Path, mismatch.Reason)
+	}
+	if conf.ManifestVerification == "fail" {
+		rollbackExtraction(e)
+		writeReport(conf.DeployDir, report)
+		return fmt.Errorf("%d of %d checked file(s) do not match the archive manifest", len(mismatches), checked)
+	}
+	log.Warnf("%d of %d checked file(s) do not match the archive manifest", len(mismatches), checked)
+	return nil
+}
+
+// rollbackExtraction undoes a failed extraction, if rollback is enabled.
+func rollbackExtraction(e *extractor) {
+	if e.journal == nil {
+		return
+	}
+
+	log.Warnf("Rolling back the partially extracted cache")
+	if err := e.rollback(); err != nil {
+		log.Warnf("Failed to roll back the extracted cache: %s", err)
+	}
+}
+
+// termination holds the extractors to roll back if the step is terminated, when restoring named caches there can be several.
+var termination struct {
+	sync.Mutex
+	extractors map[*extractor]bool
+	sigs       chan os.Signal
+	done       chan struct{}
+}
+
+// rollbackOnTermination rolls back the extraction and exits if the step receives SIGTERM or SIGINT.
+// The returned function stops listening for the signals.
+func rollbackOnTermination(e *extractor) func() {
+	termination.Lock()
+	defer termination.Unlock()
+
+	if termination.extractors == nil {
+		sigs := make(chan os.Signal, 1)
+		done := make(chan struct{})
+		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+		go func() {
+			select {
+			case sig := <-sigs:
+				termination.Lock()
+				log.Warnf("Received %s, rolling back the partially extracted cache", sig)
+				for e := range termination.extractors {
+					if err := e.journal.abort(); err != nil {
+						log.Errorf("Failed to roll back the extracted cache: %s", err)
+					}
+				}
+				os.Exit(1)
+			case <-done:
+			}
+		}()
+
+		termination.extractors = map[*extractor]bool{}
+		termination.sigs, termination.done = sigs, done
+	}
+	termination.extractors[e] = true
+
+	return func() {
+		termination.Lock()
+		defer termination.Unlock()
+
+		delete(termination.extractors, e)
+		if len(termination.extractors) == 0 {
+			signal.Stop(termination.sigs)
+			close(termination.done)
+			termination.extractors = nil
+		}
+	}
+}
+
+// writeReport saves the restore report into the deploy dir, if there is one.
+func writeReport(deployDir string, report *restoreReport) {
+	if deployDir == "" {
+		log.Debugf("No deploy dir specified, skipping the restore report")
+		return
+	}
+
+	pth, err := report.write(deployDir)
+	if err != nil {
+		log.Warnf("Failed to write restore report: %s", err)
+		return
+	}
+	log.Printf("Restore report: %s", pth)
 }
 
 func isBitriseCacheAPIURL(url string) bool {
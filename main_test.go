@@ -233,9 +233,13 @@ func Test_isSameStack(t *testing.T) {
 			want: false,
 		},
 	}
+	rules, err := loadStackRules("", "")
+	if err != nil {
+		t.Fatalf("loadStackRules() error = %v", err)
+	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := isSameStack(tt.archiveStack, tt.currentStack); got != tt.want {
+			if got := isSameStack(tt.archiveStack, tt.currentStack, rules, nil); got != tt.want {
 				t.Errorf("isSameStack() = %v, want %v", got, tt.want)
 			}
 		})
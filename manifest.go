@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"os"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// manifestFileName is the name of the manifest entry, at the top level of the archive.
+const manifestFileName = "archive_manifest.json"
+
+// manifestEntry describes how a regular file of the archive should look on disk after the restore.
+type manifestEntry struct {
+	Path   string      `json:"path"`
+	Size   int64       `json:"size"`
+	Mode   os.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256"`
+}
+
+// archiveManifest is the optional archive_manifest.json entry of a cache archive.
+type archiveManifest struct {
+	Files []manifestEntry `json:"files"`
+}
+
+// manifestMismatch is a restored file which does not match its manifest entry.
+type manifestMismatch struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// parseManifest reads the archive manifest from the given json bytes.
+func parseManifest(b []byte) (manifest archiveManifest, err error) {
+	err = json.Unmarshal(b, &manifest)
+	return
+}
+
+// verifyManifest compares a random sample of the manifest's files with the files on disk.
+// resolve returns the target path of an entry and whether the extraction deliberately did not restore it
+// (e.g. skipped by the conflict policy or the include paths), such files are not checked.
+// A file missing for any other reason is a mismatch.
+func verifyManifest(manifest archiveManifest, rate float64, resolve func(string) (string, bool)) (int, []manifestMismatch) {
+	var checked int
+	var mismatches []manifestMismatch
+	for _, entry := range manifest.Files {
+		if rate < 1 && rand.Float64() >= rate {
+			continue
+		}
+
+		target, skipped := resolve(entry.Path)
+		if skipped {
+			continue
+		}
+
+		checked++
+		if reason := verifyFile(target, entry); reason != "" {
+			log.Debugf("%s does not match the manifest: %s", target, reason)
+			mismatches = append(mismatches, manifestMismatch{Path: target, Reason: reason})
+		}
+	}
+	return checked, mismatches
+}
+
+// verifyFile returns why the file at pth does not match the manifest entry, or an empty string if it matches.
+func verifyFile(pth string, entry manifestEntry) string {
+	info, err := os.Lstat(pth)
+	if os.IsNotExist(err) {
+		return "missing"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	if !info.Mode().IsRegular() {
+		return "not a regular file"
+	}
+	if info.Size() != entry.Size {
+		return fmt.Sprintf("size is %d, expected %d", info.Size(), entry.Size)
+	}
+	if info.Mode().Perm() != entry.Mode.Perm() {
+		return fmt.Sprintf("mode is %s, expected %s", info.Mode().Perm(), entry.Mode.Perm())
+	}
+
+	sum, err := fileSHA256(pth)
+	if err != nil {
+		return err.Error()
+	}
+	if sum != entry.SHA256 {
+		return fmt.Sprintf("sha256 is %s, expected %s", sum, entry.SHA256)
+	}
+	return ""
+}
+
+func fileSHA256(pth string) (string, error) {
+	h := sha256.New()
+	if err := hashFile(h, pth); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile writes the content of the file at pth into h.
+func hashFile(h hash.Hash, pth string) error {
+	f, err := os.Open(pth)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	_, err = io.Copy(h, f)
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	archiveInfoFileName = "archive_info.json"
+	// archiveInfoPAXRecord is the PAX global header record which can hold the archive info.
+	archiveInfoPAXRecord = "BITRISE.archive_info"
+	// archiveInfoSuffix is appended to the archive URL to get the sidecar archive info's URL, if it is not specified.
+	archiveInfoSuffix = "." + archiveInfoFileName
+	// maxArchiveInfoSize caps how much is read from an archive info, it is only a few hundred bytes normally.
+	maxArchiveInfoSize = 1024 * 1024
+)
+
+// readArchiveInfo returns the content of the archive info, if it is at the beginning of the archive:
+// the first entry, or a record of the PAX global header or the entry following it.
+func readArchiveInfo(tr *tar.Reader, hdr *tar.Header) ([]byte, error) {
+	if hdr != nil && hdr.Typeflag == tar.TypeXGlobalHeader {
+		if info, ok := hdr.PAXRecords[archiveInfoPAXRecord]; ok {
+			log.Printf("Archive info found in the PAX global header")
+			return []byte(info), nil
+		}
+
+		next, err := tr.Next()
+		if err != nil {
+			log.Debugf("Failed to read the entry after the PAX global header: %s", err)
+			return nil, nil
+		}
+		hdr = next
+	}
+
+	if hdr == nil || filepath.Base(hdr.Name) != archiveInfoFileName {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(tr, maxArchiveInfoSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read first archive entry: %s", err)
+	}
+	return b, nil
+}
+
+// isMetadataEntry reports whether the entry is the given metadata file at the top level of the archive
+// (e.g. archive_manifest.json, ./archive_manifest.json or /archive_manifest.json).
+// Restored files of the same name deeper in the tree are not metadata.
+func isMetadataEntry(hdr *tar.Header, fileName string) bool {
+	return hdr.Typeflag == tar.TypeReg && strings.TrimPrefix(path.Clean("/"+hdr.Name), "/") == fileName
+}
+
+// archiveInfoURL returns where the sidecar archive info of the cache source is, if it can have one.
+func archiveInfoURL(src cacheSource) string {
+	switch {
+	case src.Parts.pattern != "":
+		return strings.Replace(src.Parts.pattern, partPlaceholder, archiveInfoFileName, 1)
+	case !src.Parts.empty(), isBitriseCacheAPIURL(src.URL):
+		return ""
+	default:
+		return sidecarURL(src.URL, archiveInfoSuffix)
+	}
+}
+
+// fetchArchiveInfo downloads a sidecar archive info, it returns nil if there is none at the given URL.
+func fetchArchiveInfo(url string) ([]byte, error) {
+	if url == "" {
+		return nil, nil
+	}
+
+	body, err := openPart(url)
+	if err != nil {
+		if errors.Is(err, errPartNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer func() {
+		if err := body.Close(); err != nil {
+			log.Warnf("Failed to close archive info: %s", err)
+		}
+	}()
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxArchiveInfoSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive info: %s", err)
+	}
+	return b, nil
+}
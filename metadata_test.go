@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_readArchiveInfo(t *testing.T) {
+	info := `{"stack_id": "linux-docker-android-22.04"}`
+
+	tests := []struct {
+		name    string
+		headers []*tar.Header
+		want    string
+	}{
+		{
+			name:    "first entry",
+			headers: []*tar.Header{{Name: "/tmp/archive_info.json", Typeflag: tar.TypeReg, Size: int64(len(info))}},
+			want:    info,
+		},
+		{
+			name:    "PAX global header",
+			headers: []*tar.Header{{Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{archiveInfoPAXRecord: info}}},
+			want:    info,
+		},
+		{
+			name: "entry after a PAX global header",
+			headers: []*tar.Header{
+				{Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "git archive"}},
+				{Name: "/tmp/archive_info.json", Typeflag: tar.TypeReg, Size: int64(len(info))},
+			},
+			want: info,
+		},
+		{
+			name:    "no archive info",
+			headers: []*tar.Header{{Name: "/tmp/file", Typeflag: tar.TypeReg, Size: int64(len(info))}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, hdr := range tt.headers {
+				hdr.Format = tar.FormatPAX
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatalf("failed to write header: %s", err)
+				}
+				if hdr.Size > 0 {
+					if _, err := tw.Write([]byte(info)); err != nil {
+						t.Fatalf("failed to write content: %s", err)
+					}
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatalf("failed to close archive: %s", err)
+			}
+
+			tr, hdr, _, err := readFirstEntry(&buf)
+			if err != nil {
+				t.Fatalf("readFirstEntry() error = %v", err)
+			}
+			got, err := readArchiveInfo(tr, hdr)
+			if err != nil {
+				t.Fatalf("readArchiveInfo() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("readArchiveInfo() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractor_trailingArchiveInfo(t *testing.T) {
+	dir := t.TempDir()
+	info := `{"stack_id": "osx-xcode-15.0.x"}`
+	// restored files named archive_info.json deeper in the tree are not the archive info
+	archive := createTestArchive(t, []testEntry{
+		{name: filepath.Join(dir, "cache/a"), content: "a"},
+		{name: "./" + archiveInfoFileName, content: info},
+		{name: filepath.Join(dir, "cache", archiveInfoFileName), content: "{}"},
+	})
+
+	e := newExtractor(extractOptions{}, &restoreReport{})
+	e.enableRollback()
+	if err := e.extract(archive); err != nil {
+		t.Fatalf("extract() error = %v", err)
+	}
+	if e.archiveInfo != nil {
+		t.Errorf("archiveInfo = %s, want none, as it is not the last entry", e.archiveInfo)
+	}
+	if err := e.rollback(); err != nil {
+		t.Fatalf("rollback() error = %v", err)
+	}
+
+	archive = createTestArchive(t, []testEntry{
+		{name: filepath.Join(dir, "cache/a"), content: "a"},
+		{name: filepath.Join(dir, "cache", archiveInfoFileName), content: "{}"},
+		{name: archiveInfoFileName, content: info},
+	})
+	if err := e.extract(archive); err != nil {
+		t.Fatalf("extract() error = %v", err)
+	}
+	if got := string(e.archiveInfo); got != info {
+		t.Errorf("archiveInfo = %s, want %s", got, info)
+	}
+	if _, err := os.Lstat(archiveInfoFileName); !os.IsNotExist(err) {
+		t.Errorf("the archive info should not be restored, Lstat() error = %v", err)
+	}
+
+	if err := e.rollback(); err != nil {
+		t.Fatalf("rollback() error = %v", err)
+	}
+	if got, err := filepath.Glob(filepath.Join(dir, "*")); err != nil || len(got) != 0 {
+		t.Errorf("dir content = %v, want empty after rollback", got)
+	}
+}
+
+func Test_archiveInfoURL(t *testing.T) {
+	tests := map[string]cacheSource{
+		"https://storage.example.com/cache.tar.gz.archive_info.json":           {URL: "https://storage.example.com/cache.tar.gz"},
+		"https://storage.example.com/cache.tar.gz.archive_info.json?version=2": {URL: "https://storage.example.com/cache.tar.gz?version=2"},
+		"file:///tmp/cache.tar.gz.archive_info.json":                           {Parts: archiveParts{pattern: "file:///tmp/cache.tar.gz.{part}"}},
+		"": {Parts: archiveParts{urls: []string{"file:///tmp/cache.000"}}},
+	}
+	for want, src := range tests {
+		if got := archiveInfoURL(src); got != want {
+			t.Errorf("archiveInfoURL(%s) = %s, want %s", src, got, want)
+		}
+	}
+}
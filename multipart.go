@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	// partPlaceholder is replaced by the zero-padded part index (000, 001, ...) in an archive part pattern.
+	partPlaceholder = "{part}"
+	// partPrefetchCount is the number of upcoming parts downloaded while the current one is streamed.
+	partPrefetchCount = 3
+)
+
+var errPartNotFound = errors.New("archive part not found")
+
+// archiveParts is either a list of archive part URLs, or a pattern with a {part} placeholder
+// which is expanded until a part is missing.
+type archiveParts struct {
+	urls    []string
+	pattern string
+}
+
+// parseArchiveParts parses the newline separated list of part URLs, or a single part URL pattern.
+func parseArchiveParts(s string) archiveParts {
+	var urls []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			urls = append(urls, line)
+		}
+	}
+
+	if len(urls) == 1 && strings.Contains(urls[0], partPlaceholder) {
+		return archiveParts{pattern: urls[0]}
+	}
+	return archiveParts{urls: urls}
+}
+
+// url returns the URL of the i-th part, or false if the list has no such part.
+func (p archiveParts) url(i int) (string, bool) {
+	if p.pattern != "" {
+		return strings.Replace(p.pattern, partPlaceholder, fmt.Sprintf("%03d", i), 1), true
+	}
+	if i < len(p.urls) {
+		return p.urls[i], true
+	}
+	return "", false
+}
+
+// empty reports whether no parts are specified.
+func (p archiveParts) empty() bool {
+	return p.pattern == "" && len(p.urls) == 0
+}
+
+// String ...
+func (p archiveParts) String() string {
+	if p.pattern != "" {
+		return p.pattern
+	}
+	return fmt.Sprintf("%d parts, starting with %s", len(p.urls), p.urls[0])
+}
+
+// partResult is a fetched archive part.
+type partResult struct {
+	pth  string
+	temp bool
+	err  error
+}
+
+// multiPartReader reads the parts of a split archive as one continuous stream.
+// The first part is streamed, the upcoming ones are downloaded in the background.
+type multiPartReader struct {
+	parts   archiveParts
+	tempDir string
+
+	current     io.ReadCloser
+	currentPath string
+	index       int
+	next        int
+	pending     map[int]chan partResult
+}
+
+func newMultiPartReader(parts archiveParts) (*multiPartReader, error) {
+	url, ok := parts.url(0)
+	if !ok {
+		return nil, errors.New("no archive parts specified")
+	}
+
+	body, err := openPart(url)
+	if err != nil {
+		return nil, err
+	}
+
+	tempDir, err := ioutil.TempDir("", "cache-pull-parts-")
+	if err != nil {
+		if cErr := body.Close(); cErr != nil {
+			log.Warnf("Failed to close archive part: %s", cErr)
+		}
+		return nil, err
+	}
+
+	r := &multiPartReader{
+		parts:   parts,
+		tempDir: tempDir,
+		current: body,
+		next:    1,
+		pending: map[int]chan partResult{},
+	}
+	r.prefetch()
+	return r, nil
+}
+
+// Read implements the io.Reader interface.
+func (r *multiPartReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			return 0, io.EOF
+		}
+
+		n, err := r.current.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if err := r.advance(); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close closes the current part and removes the downloaded parts.
+func (r *multiPartReader) Close() error {
+	err := r.closeCurrent()
+	for i, ch := range r.pending {
+		<-ch
+		delete(r.pending, i)
+	}
+	if rErr := os.RemoveAll(r.tempDir); err == nil {
+		err = rErr
+	}
+	return err
+}
+
+func (r *multiPartReader) prefetch() {
+	for ; r.next <= r.index+partPrefetchCount; r.next++ {
+		url, ok := r.parts.url(r.next)
+		if !ok {
+			return
+		}
+
+		ch := make(chan partResult, 1)
+		r.pending[r.next] = ch
+		go func(url, pth string) {
+			ch <- fetchPart(url, pth)
+		}(url, filepath.Join(r.tempDir, strconv.Itoa(r.next)))
+	}
+}
+
+func (r *multiPartReader) advance() error {
+	if err := r.closeCurrent(); err != nil {
+		return err
+	}
+
+	r.index++
+	ch, ok := r.pending[r.index]
+	if !ok {
+		log.Debugf("Read all %d archive parts", r.index)
+		return nil
+	}
+	delete(r.pending, r.index)
+
+	res := <-ch
+	if res.err == errPartNotFound && r.parts.pattern != "" {
+		log.Debugf("Read all %d archive parts", r.index)
+		return nil
+	}
+	if res.err != nil {
+		return fmt.Errorf("failed to download archive part %d: %s", r.index, res.err)
+	}
+
+	f, err := os.Open(res.pth)
+	if err != nil {
+		return err
+	}
+	r.current = f
+	if res.temp {
+		r.currentPath = res.pth
+	}
+
+	r.prefetch()
+	return nil
+}
+
+func (r *multiPartReader) closeCurrent() error {
+	if r.current == nil {
+		return nil
+	}
+
+	err := r.current.Close()
+	r.current = nil
+	if r.currentPath != "" {
+		if rErr := os.Remove(r.currentPath); err == nil {
+			err = rErr
+		}
+		r.currentPath = ""
+	}
+	return err
+}
+
+// length returns the total length of the parts, or -1 if it is unknown (e.g. a server does not tell a part's length).
+func (r *multiPartReader) length() int64 {
+	var total int64
+	for i := 0; ; i++ {
+		url, ok := r.parts.url(i)
+		if !ok {
+			return total
+		}
+
+		n, err := partLength(url)
+		if err == errPartNotFound && r.parts.pattern != "" && i > 0 {
+			return total
+		}
+		if err != nil || n < 0 {
+			log.Debugf("Failed to get the length of archive part %d: %v", i, err)
+			return -1
+		}
+		total += n
+	}
+}
+
+// partLength returns the length of an archive part, -1 if it is unknown.
+// It returns errPartNotFound if the part does not exist.
+func partLength(url string) (int64, error) {
+	if strings.HasPrefix(url, "file://") {
+		info, err := os.Stat(strings.TrimPrefix(url, "file://"))
+		if os.IsNotExist(err) {
+			return 0, errPartNotFound
+		}
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+
+	resp, err := client.Head(url)
+	if err != nil {
+		return 0, err
+	}
+	if err := resp.Body.Close(); err != nil {
+		log.Warnf("Failed to close response body: %s", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, nil
+	case http.StatusNotFound:
+		return 0, errPartNotFound
+	default:
+		return 0, fmt.Errorf("non success response code: %d", resp.StatusCode)
+	}
+}
+
+// openPart opens an archive part for streaming.
+func openPart(url string) (io.ReadCloser, error) {
+	if strings.HasPrefix(url, "file://") {
+		f, err := os.Open(strings.TrimPrefix(url, "file://"))
+		if os.IsNotExist(err) {
+			return nil, errPartNotFound
+		}
+		return f, err
+	}
+	return performPartRequest(url)
+}
+
+// fetchPart downloads an archive part to pth, local parts are used in place.
+func fetchPart(url, pth string) partResult {
+	if strings.HasPrefix(url, "file://") {
+		local := strings.TrimPrefix(url, "file://")
+		if _, err := os.Stat(local); err != nil {
+			if os.IsNotExist(err) {
+				err = errPartNotFound
+			}
+			return partResult{err: err}
+		}
+		return partResult{pth: local}
+	}
+
+	if err := downloadPart(url, pth); err != nil {
+		return partResult{err: err}
+	}
+	return partResult{pth: pth, temp: true}
+}
+
+// downloadCacheParts downloads all parts of the archive into a single local file and returns its path.
+func downloadCacheParts(parts archiveParts) (string, error) {
+	r, err := newMultiPartReader(parts)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			log.Warnf("Failed to clean up archive parts: %s", err)
+		}
+	}()
+
+	f, err := ioutil.TempFile("", "cache-archive-*.tar")
+	if err != nil {
+		return "", fmt.Errorf("failed to open the local cache file for write: %s", err)
+	}
+	_, err = io.Copy(f, r)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		if rErr := os.Remove(f.Name()); rErr != nil {
+			log.Warnf("Failed to remove %s: %s", f.Name(), rErr)
+		}
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMultiPartReader(t *testing.T) {
+	dir := t.TempDir()
+	content := "first part|second part|third part"
+	for i, part := range strings.SplitAfter(content, "|") {
+		pth := filepath.Join(dir, "cache.tar.gz.00"+string(rune('0'+i)))
+		if err := ioutil.WriteFile(pth, []byte(part), 0644); err != nil {
+			t.Fatalf("failed to write part: %s", err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		parts string
+	}{
+		{
+			name:  "pattern",
+			parts: "file://" + filepath.Join(dir, "cache.tar.gz.{part}"),
+		},
+		{
+			name: "list",
+			parts: "file://" + filepath.Join(dir, "cache.tar.gz.000") + "\n" +
+				"file://" + filepath.Join(dir, "cache.tar.gz.001") + "\n" +
+				"file://" + filepath.Join(dir, "cache.tar.gz.002") + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newMultiPartReader(parseArchiveParts(tt.parts))
+			if err != nil {
+				t.Fatalf("newMultiPartReader() error = %v", err)
+			}
+
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("ReadAll() error = %v", err)
+			}
+			if string(b) != content {
+				t.Errorf("content = %s, want %s", b, content)
+			}
+
+			if err := r.Close(); err != nil {
+				t.Errorf("Close() error = %v", err)
+			}
+			if _, err := os.Stat(r.tempDir); !os.IsNotExist(err) {
+				t.Errorf("temp dir should be removed, Stat() error = %v", err)
+			}
+		})
+	}
+
+	t.Run("length", func(t *testing.T) {
+		server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+		defer server.Close()
+
+		for _, parts := range []string{
+			"file://" + filepath.Join(dir, "cache.tar.gz.{part}"),
+			server.URL + "/cache.tar.gz.{part}",
+			server.URL + "/cache.tar.gz.000\n" + server.URL + "/cache.tar.gz.001\n" + server.URL + "/cache.tar.gz.002",
+		} {
+			r, err := newMultiPartReader(parseArchiveParts(parts))
+			if err != nil {
+				t.Fatalf("newMultiPartReader() error = %v", err)
+			}
+			if got := archiveLength(r); got != int64(len(content)) {
+				t.Errorf("archiveLength() of %s = %d, want %d", parts, got, len(content))
+			}
+			if err := r.Close(); err != nil {
+				t.Errorf("Close() error = %v", err)
+			}
+		}
+	})
+
+	t.Run("missing part of the list", func(t *testing.T) {
+		r, err := newMultiPartReader(parseArchiveParts("file://" + filepath.Join(dir, "cache.tar.gz.000") + "\nfile://" + filepath.Join(dir, "missing")))
+		if err != nil {
+			t.Fatalf("newMultiPartReader() error = %v", err)
+		}
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Errorf("ReadAll() expected error for missing part")
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+	})
+}
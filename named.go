@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// cacheResultsEnvKey is the step output holding the result of each named cache, as a JSON object.
+const cacheResultsEnvKey = "BITRISE_CACHE_RESULTS"
+
+var cacheNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// namedCache is a cache restored with its own source, stack policy and extraction options,
+// the unset options are taken from the step inputs.
+type namedCache struct {
+	Name string `json:"name"`
+
+	URL             string   `json:"url,omitempty"`
+	ArchiveParts    string   `json:"archive_parts,omitempty"`
+	CacheLayers     []string `json:"cache_layers,omitempty"`
+	CacheKey        string   `json:"cache_key,omitempty"`
+	RestoreKeys     []string `json:"restore_keys,omitempty"`
+	CacheBackendURL string   `json:"cache_backend_url,omitempty"`
+
+	IgnoreStackDifference *bool    `json:"ignore_stack_difference,omitempty"`
+	StackRules            []string `json:"stack_rules,omitempty"`
+	PortablePaths         []string `json:"portable_paths,omitempty"`
+	ToolchainPolicies     []string `json:"toolchain_policies,omitempty"`
+
+	IncludePaths          []string `json:"include_paths,omitempty"`
+	OnConflict            string   `json:"on_conflict,omitempty"`
+	ExtractToRelativePath *bool    `json:"extract_to_relative_path,omitempty"`
+	AtomicRestore         *bool    `json:"atomic_restore,omitempty"`
+	RollbackOnFailure     *bool    `json:"rollback_on_failure,omitempty"`
+}
+
+// parseNamedCaches parses the JSON list of named caches.
+func parseNamedCaches(s string) ([]namedCache, error) {
+	var caches []namedCache
+	if err := json.Unmarshal([]byte(s), &caches); err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for _, c := range caches {
+		if !cacheNamePattern.MatchString(c.Name) {
+			return nil, fmt.Errorf("invalid cache name %q, it should only contain letters, digits, - and _", c.Name)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicate cache name: %s", c.Name)
+		}
+		names[c.Name] = true
+
+		sources := 0
+		for _, source := range []bool{c.URL != "", c.ArchiveParts != "", len(c.CacheLayers) > 0, c.CacheKey != ""} {
+			if source {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return nil, fmt.Errorf("cache %s should have exactly one of url, archive_parts, cache_layers and cache_key", c.Name)
+		}
+
+		switch policy := conflictPolicy(c.OnConflict); policy {
+		case "", conflictOverwrite, conflictSkipExisting, conflictKeepNewer, conflictFail:
+		default:
+			return nil, fmt.Errorf("cache %s has an invalid conflict policy: %s", c.Name, c.OnConflict)
+		}
+	}
+	return caches, nil
+}
+
+// apply returns the step config of the named cache: the step inputs overridden by the cache's options.
+func (c namedCache) apply(conf Config) Config {
+	conf.CacheAPIURL = c.URL
+	conf.ArchiveParts = c.ArchiveParts
+	conf.CacheLayers = strings.Join(c.CacheLayers, "\n")
+	conf.CacheKey = c.CacheKey
+	conf.RestoreKeys = strings.Join(c.RestoreKeys, "\n")
+	if c.CacheBackendURL != "" {
+		conf.CacheBackendURL = c.CacheBackendURL
+	}
+
+	// these belong to the base layer of a single cache
+	conf.IndexURL, conf.SignatureURL, conf.ArchiveInfoURL = "", "", ""
+
+	if c.IgnoreStackDifference != nil {
+		conf.IgnoreStackDifference = *c.IgnoreStackDifference
+	}
+	// the cache's rules and policies are applied after the step inputs
+	if len(c.StackRules) > 0 {
+		conf.StackRules += "\n" + strings.Join(c.StackRules, "\n")
+	}
+	if len(c.ToolchainPolicies) > 0 {
+		conf.ToolchainPolicies += "\n" + strings.Join(c.ToolchainPolicies, "\n")
+	}
+	if c.PortablePaths != nil {
+		conf.PortablePaths = strings.Join(c.PortablePaths, "\n")
+	}
+
+	if c.IncludePaths != nil {
+		conf.IncludePaths = strings.Join(c.IncludePaths, "\n")
+	}
+	if c.OnConflict != "" {
+		conf.OnConflict = c.OnConflict
+	}
+	if c.ExtractToRelativePath != nil {
+		conf.ExtractToRelativePath = *c.ExtractToRelativePath
+	}
+	if c.AtomicRestore != nil {
+		conf.AtomicRestore = *c.AtomicRestore
+	}
+	if c.RollbackOnFailure != nil {
+		conf.RollbackOnFailure = *c.RollbackOnFailure
+	}
+	return conf
+}
+
+// restoreNamedCaches restores the named caches concurrently and exports their outputs once all of them are done.
+// It fails the step if any of the caches failed, after the others are restored.
+// It reports whether any of the caches was restored or skipped.
+func restoreNamedCaches(conf Config, caches []namedCache, currentArchitecture string) bool {
+	outputs := &stepOutputs{}
+	results := make([]pullResult, len(caches))
+	errs := make([]error, len(caches))
+	var wg sync.WaitGroup
+	for i, c := range caches {
+		wg.Add(1)
+		go func(i int, c namedCache) {
+			defer wg.Done()
+			results[i], errs[i] = restoreCache(c.apply(conf), currentArchitecture, c.Name, outputs)
+		}(i, c)
+	}
+	wg.Wait()
+
+	fmt.Println()
+	log.Infof("Cache results")
+
+	attempted := false
+	failed := 0
+	byName := map[string]string{}
+	for i, c := range caches {
+		if errs[i] != nil {
+			log.Errorf("%s: failed: %s", c.Name, errs[i])
+			byName[c.Name] = "failed"
+			failed++
+			continue
+		}
+		log.Printf("%s: %s", c.Name, results[i])
+		byName[c.Name] = results[i].String()
+		attempted = attempted || results[i] == archiveRestored || results[i] == archiveSkipped
+	}
+
+	if !conf.DryRun {
+		if b, err := json.Marshal(byName); err != nil {
+			log.Warnf("Failed to encode cache results: %s", err)
+		} else {
+			outputs.set(cacheResultsEnvKey, string(b))
+		}
+	}
+	outputs.export()
+
+	if failed > 0 {
+		failf("Failed to restore %d of %d cache(s)", failed, len(caches))
+	}
+	return attempted
+}
+
+// outputKey returns the step output's env key for a named cache, e.g. BITRISE_CACHE_HIT_NPM, or the key itself for the unnamed cache.
+func outputKey(key, name string) string {
+	if name == "" {
+		return key
+	}
+	return key + "_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseNamedCaches(t *testing.T) {
+	tests := []struct {
+		name    string
+		caches  string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "valid",
+			caches: `[{"name": "npm", "cache_key": "npm-{{ .OS }}"}, {"name": "android-sdk", "url": "https://cache.example.com/sdk"}, {"name": "build_outputs", "cache_layers": ["file:///tmp/base.tar", "file:///tmp/delta.tar"]}]`,
+			want:   []string{"npm", "android-sdk", "build_outputs"},
+		},
+		{
+			name:    "invalid JSON",
+			caches:  `{"name": "npm"}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid name",
+			caches:  `[{"name": "npm cache", "url": "https://cache.example.com"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "duplicate name",
+			caches:  `[{"name": "npm", "url": "https://cache.example.com/1"}, {"name": "npm", "url": "https://cache.example.com/2"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "no source",
+			caches:  `[{"name": "npm"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "multiple sources",
+			caches:  `[{"name": "npm", "url": "https://cache.example.com", "cache_key": "npm"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid conflict policy",
+			caches:  `[{"name": "npm", "url": "https://cache.example.com", "on_conflict": "merge"}]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caches, err := parseNamedCaches(tt.caches)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseNamedCaches() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var got []string
+			for _, c := range caches {
+				got = append(got, c.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseNamedCaches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_namedCache_apply(t *testing.T) {
+	ignore := true
+	conf := Config{
+		CacheAPIURL:       "https://cache.example.com/step",
+		IndexURL:          "https://cache.example.com/step.index",
+		StackRules:        "equivalent osx-xcode-13.0 osx-xcode-13.1",
+		ToolchainPolicies: "*=warn",
+		IncludePaths:      "~/.gradle",
+		OnConflict:        string(conflictOverwrite),
+		MaxEntries:        100,
+	}
+	c := namedCache{
+		Name:                  "npm",
+		CacheKey:              "npm-{{ .OS }}",
+		RestoreKeys:           []string{"npm-"},
+		IgnoreStackDifference: &ignore,
+		StackRules:            []string{"allow osx-* linux-*"},
+		IncludePaths:          []string{"~/.npm", "node_modules"},
+	}
+
+	got := c.apply(conf)
+	want := Config{
+		CacheKey:              "npm-{{ .OS }}",
+		RestoreKeys:           "npm-",
+		IgnoreStackDifference: true,
+		StackRules:            "equivalent osx-xcode-13.0 osx-xcode-13.1\nallow osx-* linux-*",
+		ToolchainPolicies:     "*=warn",
+		IncludePaths:          "~/.npm\nnode_modules",
+		OnConflict:            string(conflictOverwrite),
+		MaxEntries:            100,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("apply() = %+v, want %+v", got, want)
+	}
+}
+
+func Test_outputKey(t *testing.T) {
+	if got := outputKey(cacheHitEnvKey, ""); got != "BITRISE_CACHE_HIT" {
+		t.Errorf("outputKey() = %s, want BITRISE_CACHE_HIT", got)
+	}
+	if got := outputKey(cacheHitEnvKey, "android-sdk"); got != "BITRISE_CACHE_HIT_ANDROID_SDK" {
+		t.Errorf("outputKey() = %s, want BITRISE_CACHE_HIT_ANDROID_SDK", got)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -45,15 +46,20 @@ func downloadCacheArchive(url string, buildSlug string) (string, error) {
 		return "", fmt.Errorf("non success response code: %d, body: %s", resp.StatusCode, string(responseBytes))
 	}
 
-	const cacheArchivePath = "/tmp/cache-archive.tar"
-	f, err := os.Create(cacheArchivePath)
+	f, err := ioutil.TempFile("", "cache-archive-*.tar")
 	if err != nil {
 		return "", fmt.Errorf("failed to open the local cache file for write: %s", err)
 	}
 
 	var bytesWritten int64
 	bytesWritten, err = io.Copy(f, resp.Body)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
 	if err != nil {
+		if rErr := os.Remove(f.Name()); rErr != nil {
+			log.Warnf("Failed to remove %s: %s", f.Name(), rErr)
+		}
 		return "", err
 	}
 
@@ -64,7 +70,7 @@ func downloadCacheArchive(url string, buildSlug string) (string, error) {
 	log.Debugf("Size of downloaded cache archive: %d Bytes", bytesWritten)
 	log.RInfof(stepID, "cache_fallback_archive_size", data, "Size of downloaded cache archive: %d Bytes", bytesWritten)
 
-	return cacheArchivePath, nil
+	return f.Name(), nil
 }
 
 // getCacheDownloadURL gets the given build's cache download URL.
@@ -114,6 +120,12 @@ func getCacheDownloadURL(cacheAPIURL string) (string, error) {
 	return respModel.DownloadURL, nil
 }
 
+// responseBody is a response body with the length of its content, -1 if it is unknown.
+type responseBody struct {
+	io.ReadCloser
+	length int64
+}
+
 // performRequest performs an http request and returns the response's body, if the status code is 200.
 func performRequest(url string) (io.ReadCloser, error) {
 	resp, err := client.Get(url)
@@ -136,5 +148,121 @@ func performRequest(url string) (io.ReadCloser, error) {
 		return nil, fmt.Errorf("non success response code: %d, body: %s", resp.StatusCode, string(responseBytes))
 	}
 
+	return responseBody{ReadCloser: resp.Body, length: resp.ContentLength}, nil
+}
+
+// performPartRequest performs an http request for an archive part and returns the response's body, if the status code is 200.
+// It returns errPartNotFound if the part does not exist.
+func performPartRequest(url string) (io.ReadCloser, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		defer func() {
+			if err := resp.Body.Close(); err != nil {
+				log.Warnf("Failed to close response body: %s", err)
+			}
+		}()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errPartNotFound
+		}
+
+		responseBytes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("non success response code: %d, body: %s", resp.StatusCode, string(responseBytes))
+	}
+
 	return resp.Body, nil
 }
+
+// downloadPart downloads an archive part to the given path.
+// It returns errPartNotFound if the part does not exist.
+func downloadPart(url, pth string) error {
+	body, err := performPartRequest(url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	f, err := os.Create(pth)
+	if err != nil {
+		return fmt.Errorf("failed to open the local part file for write: %s", err)
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		if cErr := f.Close(); cErr != nil {
+			log.Warnf("Failed to close %s: %s", pth, cErr)
+		}
+		return err
+	}
+	return f.Close()
+}
+
+// performRangeRequest requests a byte range of the given URL and returns the response's body, if the status code is 206.
+func performRangeRequest(url string, offset, length int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %s", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := client.StandardClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		defer func() {
+			if err := resp.Body.Close(); err != nil {
+				log.Warnf("Failed to close response body: %s", err)
+			}
+		}()
+
+		if resp.StatusCode == http.StatusOK {
+			return nil, errors.New("range requests are not supported")
+		}
+
+		responseBytes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("non success response code: %d, body: %s", resp.StatusCode, string(responseBytes))
+	}
+
+	return resp.Body, nil
+}
+
+// signatureQueryParams are the query parameters of presigned URLs (S3, GCS, CloudFront and Azure SAS).
+var signatureQueryParams = []string{"x-amz-signature", "x-goog-signature", "signature", "sig"}
+
+// sidecarURL returns the URL of a file stored next to the archive, by appending the suffix to the path of the archive URL.
+// It returns an empty string for presigned URLs: the signature covers the path, so the sidecar's URL has to be configured.
+func sidecarURL(archiveURL, suffix string) string {
+	u, err := url.Parse(archiveURL)
+	if err != nil {
+		return archiveURL + suffix
+	}
+	for key := range u.Query() {
+		for _, param := range signatureQueryParams {
+			if strings.EqualFold(key, param) {
+				return ""
+			}
+		}
+	}
+
+	u.Path += suffix
+	if u.RawPath != "" {
+		u.RawPath += suffix
+	}
+	return u.String()
+}
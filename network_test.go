@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_sidecarURL(t *testing.T) {
+	tests := map[string]string{
+		"https://storage.example.com/cache.tar.gz":                     "https://storage.example.com/cache.tar.gz.sig",
+		"https://storage.example.com/cache.tar.gz?X-Amz-Signature=abc": "",
+		"https://storage.example.com/cache.tar.gz?sig=abc&sv=2020":     "",
+		"https://storage.example.com/a%2Fb.tar.gz?version=2":           "https://storage.example.com/a%2Fb.tar.gz.sig?version=2",
+		"file:///tmp/cache.tar.gz":                                     "file:///tmp/cache.tar.gz.sig",
+	}
+	for archiveURL, want := range tests {
+		if got := sidecarURL(archiveURL, signatureSuffix); got != want {
+			t.Errorf("sidecarURL(%s) = %s, want %s", archiveURL, got, want)
+		}
+	}
+}
+
+func Test_downloadCacheArchive_interrupted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the connection is closed before the announced length is sent
+		w.Header().Set("Content-Length", "1024")
+		if _, err := w.Write([]byte("partial")); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+
+	if _, err := downloadCacheArchive(server.URL+"/cache.tar", ""); err == nil {
+		t.Fatalf("downloadCacheArchive() error = nil, want an interrupted download")
+	}
+	if files, err := ioutil.ReadDir(tempDir); err != nil || len(files) != 0 {
+		t.Errorf("temp dir content = %v, want the partial download removed", files)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// stepOutputs collects the step outputs of the restored caches, to export them once every cache is done:
+// envman add calls running in parallel can lose each other's changes.
+type stepOutputs struct {
+	mu     sync.Mutex
+	keys   []string
+	values map[string]string
+}
+
+// set records the value of an output, replacing the earlier value of the same key.
+func (o *stepOutputs) set(key, value string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.values == nil {
+		o.values = map[string]string{}
+	}
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// export exports the outputs with envman, in the order they were first set.
+func (o *stepOutputs) export() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, key := range o.keys {
+		if err := command.New("envman", "add", "--key", key, "--value", o.values[key]).Run(); err != nil {
+			log.Warnf("Failed to export %s: %s", key, err)
+		}
+	}
+}
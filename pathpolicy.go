@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pathPolicy restricts where archive entries can be restored to, by absolute path prefixes.
+// An entry under a denied prefix is blocked, even if it is also under an allowed one.
+// An empty allow list allows every path which is not denied.
+type pathPolicy struct {
+	Allow []string
+	Deny  []string
+}
+
+// empty reports whether the policy allows every path.
+func (p pathPolicy) empty() bool {
+	return len(p.Allow) == 0 && len(p.Deny) == 0
+}
+
+// resolved returns the policy with the symlinks of the prefixes resolved, for checking resolved paths.
+func (p pathPolicy) resolved() pathPolicy {
+	return pathPolicy{Allow: resolvePaths(p.Allow), Deny: resolvePaths(p.Deny)}
+}
+
+func resolvePaths(pths []string) []string {
+	var resolved []string
+	for _, pth := range pths {
+		if r, err := resolvePath(pth); err == nil {
+			pth = r
+		}
+		resolved = append(resolved, pth)
+	}
+	return resolved
+}
+
+// allows reports whether an entry can be restored to the given target path.
+// The path is compared as written, symlinks are resolved by the caller.
+func (p pathPolicy) allows(target string) bool {
+	if p.empty() {
+		return true
+	}
+
+	pth, err := filepath.Abs(target)
+	if err != nil {
+		return false
+	}
+
+	for _, prefix := range p.Deny {
+		if hasPathPrefix(pth, prefix) {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, prefix := range p.Allow {
+		if hasPathPrefix(pth, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPathPrefix reports whether pth is prefix or is inside the prefix directory.
+func hasPathPrefix(pth, prefix string) bool {
+	if pth == prefix || prefix == string(filepath.Separator) {
+		return true
+	}
+	return strings.HasPrefix(pth, prefix+string(filepath.Separator))
+}
+
+// resolvePath returns pth with the symlinks of its longest existing prefix resolved.
+// The not yet existing rest of the path is kept as is.
+func resolvePath(pth string) (string, error) {
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(pth)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if _, lerr := os.Lstat(pth); lerr == nil {
+			// a dangling symlink, it is not known where the rest of the path would be created
+			return "", err
+		}
+
+		parent := filepath.Dir(pth)
+		if parent == pth {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(pth)}, rest...)
+		pth = parent
+	}
+}
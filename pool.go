@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// maxPooledFileSize is the size above which files are written by the archive reader itself,
+// instead of buffering their whole content for the writer pool.
+const maxPooledFileSize = 1 << 20
+
+// writeJob is a regular file to be written by the writer pool.
+type writeJob struct {
+	target  string
+	content []byte
+	hdr     *tar.Header
+	minHole int64
+}
+
+// writerPool writes files on a bounded number of goroutines, while the archive is decoded on the caller's goroutine.
+type writerPool struct {
+	jobs    chan writeJob
+	begin   func() func()
+	pending sync.WaitGroup
+
+	mu    sync.Mutex
+	err   error
+	holes int64
+}
+
+// newWriterPool starts the workers, begin is called before writing each file and the returned function after it.
+func newWriterPool(size int, begin func() func()) *writerPool {
+	p := &writerPool{jobs: make(chan writeJob, size), begin: begin}
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *writerPool) work() {
+	for job := range p.jobs {
+		done := p.begin()
+		skipped, err := writeFile(job.target, bytes.NewReader(job.content), job.hdr, job.minHole)
+		done()
+		if err != nil {
+			p.setErr(fmt.Errorf("failed to extract %s: %s", job.hdr.Name, err))
+		}
+		atomic.AddInt64(&p.holes, skipped)
+		p.pending.Done()
+	}
+}
+
+func (p *writerPool) setErr(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *writerPool) firstErr() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.err
+}
+
+// skipped returns the number of bytes written as holes by the pool.
+func (p *writerPool) skipped() int64 {
+	return atomic.LoadInt64(&p.holes)
+}
+
+// submit queues a file to be written. It returns the first error of the already written files, if any.
+func (p *writerPool) submit(job writeJob) error {
+	if err := p.firstErr(); err != nil {
+		return err
+	}
+
+	p.pending.Add(1)
+	p.jobs <- job
+	return nil
+}
+
+// flush waits until every queued file is written.
+func (p *writerPool) flush() error {
+	p.pending.Wait()
+	return p.firstErr()
+}
+
+// close waits for the queued files and stops the workers.
+func (p *writerPool) close() error {
+	err := p.flush()
+	close(p.jobs)
+	return err
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// portableInfo is the list of stack-agnostic paths the cache push step can store in the archive info.
+type portableInfo struct {
+	// PortablePaths are the paths (or glob patterns) which can be restored on any stack, e.g. the Gradle wrapper zips.
+	PortablePaths []string `json:"portable_paths,omitempty"`
+}
+
+// portablePaths returns the paths of the archive which can be restored on a different stack:
+// the ones tagged as portable in the archive info and the configured ones.
+func portablePaths(archiveInfo []byte, configured includeFilter) includeFilter {
+	var info portableInfo
+	if archiveInfo != nil {
+		if err := json.Unmarshal(archiveInfo, &info); err != nil {
+			log.Debugf("Failed to parse archive portable paths: %s", err)
+		}
+	}
+
+	portable := append(includeFilter{}, configured...)
+	for _, pth := range info.PortablePaths {
+		portable = append(portable, filepath.Clean(pth))
+	}
+	return portable
+}
@@ -0,0 +1,755 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+	"github.com/bitrise-steplib/steps-cache-push/model"
+	"github.com/docker/go-units"
+)
+
+// pullResult tells what happened to a cache archive.
+type pullResult int
+
+const (
+	archiveRestored pullResult = iota
+	archiveNotFound
+	archiveSkipped
+	archiveListed
+)
+
+// String ...
+func (r pullResult) String() string {
+	switch r {
+	case archiveRestored:
+		return "restored"
+	case archiveNotFound:
+		return "not-found"
+	case archiveSkipped:
+		return "skipped"
+	default:
+		return "listed"
+	}
+}
+
+// cacheSource is a cache archive to restore: a Cache API or archive URL, or the parts of a split archive.
+// Layer is the archive's index in the layered restore, 0 for the base (or only) archive.
+type cacheSource struct {
+	URL   string
+	Parts archiveParts
+	Layer int
+	// Branches are the fallback branches of a Cache API URL, tried in order if the current branch has no cache.
+	Branches []cacheBranch
+}
+
+// String ...
+func (s cacheSource) String() string {
+	if !s.Parts.empty() {
+		return s.Parts.String()
+	}
+	return s.URL
+}
+
+// cacheSources returns the archives to restore, in order: the cache layers if specified,
+// otherwise the archive parts or the Cache API URL.
+func cacheSources(conf Config) []cacheSource {
+	if conf.CacheLayers != "" {
+		var sources []cacheSource
+		for _, line := range strings.Split(conf.CacheLayers, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+
+			src := cacheSource{URL: line, Layer: len(sources)}
+			if strings.Contains(line, partPlaceholder) {
+				src = cacheSource{Parts: parseArchiveParts(line), Layer: len(sources)}
+			}
+			sources = append(sources, src)
+		}
+		return sources
+	}
+
+	if conf.ArchiveParts != "" {
+		return []cacheSource{{Parts: parseArchiveParts(conf.ArchiveParts)}}
+	}
+	if conf.CacheAPIURL != "" {
+		return []cacheSource{{URL: conf.CacheAPIURL, Branches: fallbackBranches(conf)}}
+	}
+	return nil
+}
+
+// openCacheSource starts reading the cache archive and returns the reader and the archive's download URL.
+// It returns false if there is no saved cache.
+func (p puller) openCacheSource(src cacheSource) (io.Reader, string, bool, error) {
+	if !src.Parts.empty() {
+		logSection(p.name, "Downloading multi-part cache archive")
+		log.Printf("parts: %s", src.Parts)
+
+		r, err := newMultiPartReader(src.Parts)
+		if err != nil {
+			if errors.Is(err, errPartNotFound) {
+				return nil, "", false, nil
+			}
+			return nil, "", false, fmt.Errorf("failed to open cache archive parts: %s", err)
+		}
+		return r, "", true, nil
+	}
+
+	cacheURI := src.URL
+	if isBitriseCacheAPIURL(src.URL) {
+		var ok bool
+		var err error
+		if cacheURI, ok, err = p.resolveBranchCache(src); err != nil || !ok {
+			return nil, "", false, err
+		}
+	}
+
+	if r, ok := p.openSelected(src, cacheURI); ok {
+		return r, cacheURI, true, nil
+	}
+
+	if strings.HasPrefix(cacheURI, "file://") {
+		logSection(p.name, "Using local cache archive")
+
+		r, err := os.Open(strings.TrimPrefix(cacheURI, "file://"))
+		if err != nil {
+			return nil, "", false, fmt.Errorf("failed to open cache archive file: %s", err)
+		}
+		return r, cacheURI, true, nil
+	}
+
+	logSection(p.name, "Downloading remote cache archive")
+
+	r, err := performRequest(cacheURI)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("failed to perform cache download request: %s", err)
+	}
+	return r, cacheURI, true, nil
+}
+
+// openSelected downloads only the parts of the archive holding the included entries, using the archive index.
+// It returns false if the whole archive has to be downloaded: there is no include filter or index,
+// or the whole archive is needed for decryption or signature verification.
+func (p puller) openSelected(src cacheSource, cacheURI string) (io.Reader, bool) {
+	if len(p.include) == 0 || p.conf.DryRun || p.key != nil || p.conf.SignatureVerification != "off" {
+		return nil, false
+	}
+
+	url := ""
+	if !isBitriseCacheAPIURL(src.URL) {
+		url = sidecarURL(src.URL, indexSuffix)
+	}
+	if p.conf.IndexURL != "" && src.Layer == 0 {
+		url = p.conf.IndexURL
+	}
+
+	index, err := fetchIndex(url)
+	if err != nil {
+		if !errors.Is(err, errIndexNotFound) {
+			log.Warnf("Failed to download archive index: %s", err)
+		}
+		log.Debugf("No archive index, downloading the whole archive")
+		return nil, false
+	}
+
+	ranges, total := index.ranges(p.include)
+	var size int64
+	for _, r := range ranges {
+		size += r.length
+	}
+
+	logSection(p.name, "Downloading the included entries of the cache archive")
+	log.Printf("%s of %s, in %d range(s)", units.HumanSizeWithPrecision(float64(size), 3), units.HumanSizeWithPrecision(float64(total), 3), len(ranges))
+
+	r, err := newRangeReader(cacheURI, ranges)
+	if err != nil {
+		log.Warnf("Failed to download the included entries, downloading the whole archive: %s", err)
+		return nil, false
+	}
+	return r, true
+}
+
+// puller restores cache archives into the same extractor and report.
+type puller struct {
+	name      string
+	conf      Config
+	key       []byte
+	publicKey ed25519.PublicKey
+	stack     model.ArchiveInfo
+	rules     stackRules
+	archRules stackRules
+	policies  toolchainPolicies
+	toolchain *currentToolchain
+	include   includeFilter
+	portable  includeFilter
+	ext       *extractor
+	report    *restoreReport
+	outputs   *stepOutputs
+}
+
+// pull downloads, checks and extracts a cache archive.
+// Encrypted archives are decrypted with the given key.
+// A failed extraction is rolled back, if rollback is enabled.
+func (p puller) pull(src cacheSource) (pullResult, error) {
+	conf, ext, report := p.conf, p.ext, p.report
+
+	downloadStartTime := time.Now()
+
+	cacheReader, cacheURI, ok, err := p.openCacheSource(src)
+	if err != nil {
+		return archiveNotFound, err
+	}
+	if !ok {
+		log.Donef("No saved cache found")
+		return archiveNotFound, nil
+	}
+	defer func() {
+		if c, ok := cacheReader.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Warnf("Failed to close cache archive: %s", err)
+			}
+		}
+	}()
+
+	signature, err := p.fetchSignature(src)
+	if err != nil {
+		return archiveSkipped, err
+	}
+
+	// with the verification set to fail nothing is extracted before the signature is verified,
+	// otherwise the signature is verified after the extraction, from the digest of the streamed archive
+	verifiedPath := ""
+	if conf.SignatureVerification == "fail" && !conf.DryRun {
+		verified, temporary, err := p.downloadVerified(cacheReader, signature)
+		if err != nil {
+			return archiveSkipped, err
+		}
+		verifiedPath = verified.Name()
+		if temporary {
+			defer func() {
+				if err := os.Remove(verifiedPath); err != nil {
+					log.Warnf("Failed to remove %s: %s", verifiedPath, err)
+				}
+			}()
+		}
+		if c, ok := cacheReader.(io.Closer); ok && temporary {
+			if err := c.Close(); err != nil {
+				log.Warnf("Failed to close cache archive: %s", err)
+			}
+		}
+		cacheReader = verified
+	}
+
+	digest := sha256.New()
+	hashed := cacheReader
+	if conf.SignatureVerification == "warn" {
+		hashed = io.TeeReader(cacheReader, digest)
+	}
+
+	archiveReader, encrypted, err := openEnvelope(hashed, p.key)
+	if err != nil {
+		return archiveSkipped, fmt.Errorf("failed to open cache archive: %s", err)
+	}
+	if encrypted {
+		log.Printf("Cache archive is encrypted, decrypting it with the given key")
+	} else if p.key != nil {
+		log.Warnf("An encryption key is specified, but the cache archive is not encrypted")
+	}
+
+	log.Printf("Archive downloaded in %s", time.Since(downloadStartTime).Round(time.Second))
+
+	restoreStartTime := time.Now()
+	cacheRecorderReader := NewRestoreReader(archiveReader)
+
+	r, hdr, compressed, err := readFirstEntry(cacheRecorderReader)
+	if err != nil {
+		return archiveSkipped, fmt.Errorf("failed to get first archive entry: %s", err)
+	}
+
+	archiveInfo, err := readArchiveInfo(r, hdr)
+	if err != nil {
+		return archiveSkipped, err
+	}
+	cacheRecorderReader.Restore()
+	if archiveInfo == nil {
+		archiveInfo = p.fetchArchiveInfo(src)
+	}
+
+	// an archive info entry at the end of the archive can only be checked after extraction,
+	// an incompatible archive is rolled back then
+	deferred := archiveInfo == nil && !conf.DryRun
+	var portable, excluded includeFilter
+	if deferred {
+		log.Printf("No archive info at the beginning of the archive, checking it after extraction")
+		ext.enableRollback()
+	} else {
+		var restore bool
+		if portable, excluded, restore, err = p.checkArchiveInfo(archiveInfo, false); err != nil {
+			return archiveSkipped, err
+		} else if !restore {
+			return archiveSkipped, nil
+		}
+	}
+
+	if conf.DiskSpaceCheck && !conf.DryRun {
+		release, fits := p.checkDiskSpace(archiveInfo, archiveLength(cacheReader), compressed)
+		if !fits {
+			log.Warnf("Skipping cache pull, as there is not enough free disk space to restore it")
+			return archiveSkipped, nil
+		}
+
+		// a manifest read before any restored entry tells the exact sizes, its check replaces this one
+		ext.manifestCheck = func(manifest archiveManifest) error {
+			release()
+			if release, fits = p.checkManifestDiskSpace(manifest); !fits {
+				return diskSpaceError{}
+			}
+			return nil
+		}
+		defer func() {
+			ext.manifestCheck = nil
+			release()
+		}()
+	}
+
+	if conf.DryRun {
+		if err := listArchive(cacheRecorderReader, compressed, conf.DeployDir, p.name, src.Layer); err != nil {
+			return archiveListed, err
+		}
+		return archiveListed, nil
+	}
+
+	logSection(p.name, "Extracting cache archive")
+
+	ext.opts.Compressed = compressed
+	ext.opts.Whiteouts = src.Layer > 0
+	ext.opts.Portable = portable
+	ext.opts.Exclude = excluded
+
+	extractedWithTar := false
+	if err := extractCacheArchive(cacheRecorderReader, ext); err != nil {
+		rollbackExtraction(ext)
+
+		var dErr diskSpaceError
+		if errors.As(err, &dErr) {
+			log.Warnf("Skipping cache pull, as there is not enough free disk space to restore it")
+			return archiveSkipped, nil
+		}
+
+		// retrying the same archive would fail the same way
+		var cErr conflictError
+		var lErr limitError
+		if errors.As(err, &cErr) || errors.As(err, &lErr) {
+			writeReport(conf.DeployDir, report)
+			return archiveSkipped, fmt.Errorf("failed to extract cache archive: %s", err)
+		}
+
+		if !conf.AllowFallback {
+			return archiveSkipped, fmt.Errorf("failed to uncompress cache archive stream: %s", err)
+		}
+
+		// the tar tool can read archives the native extractor cannot, if it can enforce the extraction options
+		tarArgs, useTar := ext.tarArgs(isGNUTar())
+		useTar = useTar && !encrypted
+
+		log.Warnf("Failed to uncompress cache archive stream: %s", err)
+		if useTar {
+			log.Warnf("Downloading the archive file and trying to uncompress using tar tool")
+		} else {
+			log.Warnf("Downloading the archive file and trying to extract it from disk")
+		}
+		data := map[string]interface{}{
+			"archive_bytes_read": cacheRecorderReader.BytesRead,
+			"build_slug":         conf.BuildSlug,
+		}
+		log.RInfof(stepID, "cache_archive_fallback", data, "Failed to uncompress cache archive stream: %s", err)
+
+		// a downloaded again archive would have to be verified again
+		pth := verifiedPath
+		if pth != "" {
+			err = nil
+		} else if !src.Parts.empty() {
+			pth, err = downloadCacheParts(src.Parts)
+		} else {
+			pth, err = downloadCacheArchive(cacheURI, conf.BuildSlug)
+		}
+		if err != nil {
+			return archiveSkipped, fmt.Errorf("fallback failed, unable to download cache archive: %s", err)
+		}
+		// the downloaded copy would hold on to the disk space reserved for the restored files
+		if pth != verifiedPath && (!src.Parts.empty() || !strings.HasPrefix(cacheURI, "file://")) {
+			defer func() {
+				if err := os.Remove(pth); err != nil {
+					log.Warnf("Failed to remove %s: %s", pth, err)
+				}
+			}()
+		}
+
+		if useTar {
+			err = uncompressArchiveWithTar(pth, tarArgs)
+			extractedWithTar = err == nil
+		} else {
+			err = uncompressArchive(pth, p.key, ext)
+		}
+		if err != nil {
+			rollbackExtraction(ext)
+			writeReport(conf.DeployDir, report)
+			return archiveSkipped, fmt.Errorf("fallback failed, unable to uncompress cache archive file: %s", err)
+		}
+
+		if conf.SignatureVerification == "warn" {
+			digest.Reset()
+			if err := hashFile(digest, pth); err != nil {
+				rollbackExtraction(ext)
+				return archiveSkipped, fmt.Errorf("failed to hash cache archive file: %s", err)
+			}
+		}
+	} else {
+		// the archive's trailing bytes (e.g. the end of the encryption envelope) are part of the signed digest
+		if _, err := io.Copy(ioutil.Discard, archiveReader); err != nil {
+			rollbackExtraction(ext)
+			return archiveSkipped, fmt.Errorf("failed to read the end of the cache archive: %s", err)
+		}
+
+		data := map[string]interface{}{
+			"cache_archive_size": cacheRecorderReader.BytesRead,
+			"build_slug":         conf.BuildSlug,
+		}
+		log.Debugf("Size of extracted cache archive: %d Bytes", cacheRecorderReader.BytesRead)
+		log.RInfof(stepID, "cache_archive_size", data, "Size of extracted cache archive: %d Bytes", cacheRecorderReader.BytesRead)
+	}
+
+	if deferred {
+		if archiveInfo := ext.archiveInfo; archiveInfo != nil {
+			log.Printf("Archive info found in the archive")
+			_, _, restore, err := p.checkArchiveInfo(archiveInfo, true)
+			if err != nil || !restore {
+				rollbackExtraction(ext)
+				return archiveSkipped, err
+			}
+		} else if p.stack.StackID != "" {
+			checkArchiveStack(conf, nil, p.stack, p.rules, p.archRules, p.name)
+		}
+	}
+
+	if conf.SignatureVerification == "warn" {
+		p.verifySignature(digest.Sum(nil), signature)
+	}
+
+	if conf.ManifestVerification != "off" && extractedWithTar {
+		log.Warnf("Cache archive was extracted with the tar tool, skipping manifest verification")
+	} else if conf.ManifestVerification != "off" {
+		if err := verifyRestoredFiles(ext, conf, report); err != nil {
+			return archiveSkipped, err
+		}
+	}
+
+	ext.finish()
+
+	size := units.HumanSizeWithPrecision(float64(cacheRecorderReader.BytesRead), 3)
+	log.Printf("Cache archive size: %s", size)
+	log.Printf("Extracted archive contents in %s", time.Since(restoreStartTime).Round(time.Second))
+
+	return archiveRestored, nil
+}
+
+// fetchSignature downloads the archive's signature if signature verification is enabled.
+// It refuses the archive right away if the signature is missing and the verification is set to fail.
+func (p puller) fetchSignature(src cacheSource) ([]byte, error) {
+	if p.conf.SignatureVerification == "off" || p.conf.DryRun {
+		return nil, nil
+	}
+
+	url := signatureURL(src)
+	if p.conf.SignatureURL != "" && src.Layer == 0 {
+		url = p.conf.SignatureURL
+	}
+
+	sig, err := fetchSignature(url)
+	if err == nil {
+		return sig, nil
+	}
+	if !errors.Is(err, errSignatureNotFound) {
+		log.Warnf("Failed to download cache archive signature: %s", err)
+	}
+
+	if p.conf.SignatureVerification == "fail" {
+		p.report.setSignatureStatus(signatureMissing)
+		return nil, errors.New("cache archive is not signed, refusing to restore it")
+	}
+	return nil, nil
+}
+
+// downloadVerified downloads the archive into a temporary file, or uses the local archive file, and verifies its signature
+// before anything is extracted. It returns the opened file and whether it is temporary,
+// or an error if the signature is not valid.
+func (p puller) downloadVerified(r io.Reader, sig []byte) (*os.File, bool, error) {
+	logSection(p.name, "Downloading cache archive for signature verification")
+
+	f, ok := r.(*os.File)
+	if !ok {
+		var err error
+		if f, err = ioutil.TempFile("", "cache-archive-*.tar"); err != nil {
+			return nil, false, fmt.Errorf("failed to create cache archive file: %s", err)
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			removeTempArchive(f)
+			return nil, false, fmt.Errorf("failed to download cache archive: %s", err)
+		}
+	}
+
+	digest := sha256.New()
+	err := hashFrom(digest, f)
+	if err == nil && !p.verifySignature(digest.Sum(nil), sig) {
+		writeReport(p.conf.DeployDir, p.report)
+		err = errors.New("cache archive signature verification failed, refusing to restore the untrusted cache")
+	}
+	if err != nil {
+		if !ok {
+			removeTempArchive(f)
+		}
+		return nil, false, err
+	}
+	return f, !ok, nil
+}
+
+// hashFrom writes the content of the file into h, and seeks back to its beginning.
+func hashFrom(h hash.Hash, f *os.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read cache archive: %s", err)
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to hash cache archive: %s", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read cache archive: %s", err)
+	}
+	return nil
+}
+
+func removeTempArchive(f *os.File) {
+	if err := f.Close(); err != nil {
+		log.Warnf("Failed to close %s: %s", f.Name(), err)
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		log.Warnf("Failed to remove %s: %s", f.Name(), err)
+	}
+}
+
+// verifySignature verifies the archive's signature and reports whether it is valid.
+func (p puller) verifySignature(digest, sig []byte) bool {
+	logSection(p.name, "Verifying cache archive signature")
+
+	status := verifyArchiveSignature(p.publicKey, digest, sig)
+	p.report.setSignatureStatus(status)
+
+	switch status {
+	case signatureVerified:
+		log.Donef("Cache archive signature is valid")
+		return true
+	case signatureMissing:
+		log.Warnf("Cache archive is not signed")
+	default:
+		log.Warnf("Cache archive signature is invalid")
+	}
+	return false
+}
+
+// checkDiskSpace compares the expected size of the restored archive with the free space of each target filesystem,
+// less the space reserved by the other caches being restored. It returns false if the archive does not fit,
+// otherwise its space is reserved until the returned function is called.
+func (p puller) checkDiskSpace(archiveInfo []byte, length int64, compressed bool) (func(), bool) {
+	logSection(p.name, "Checking free disk space")
+
+	defaultPath := pathutil.UserHomeDir()
+	if p.conf.ExtractToRelativePath {
+		defaultPath = "."
+	}
+
+	sizes, ok := expectedSizes(archiveInfo, length, compressed, defaultPath)
+	if !ok {
+		log.Warnf("The size of the cache archive is unknown, skipping disk space check")
+		return func() {}, true
+	}
+
+	targets := map[string]int64{}
+	for pth, size := range sizes {
+		target := pth
+		if pth != defaultPath {
+			var err error
+			if target, err = p.ext.targetPath(pth); err != nil {
+				log.Warnf("Invalid cached path in the archive info: %s", err)
+				continue
+			}
+		}
+		targets[target] += size
+	}
+
+	usages, err := filesystemUsages(targets)
+	if err != nil {
+		log.Warnf("Failed to check free disk space: %s", err)
+		return func() {}, true
+	}
+
+	release, fits := reserveDiskSpace(usages)
+	logDiskUsages(usages)
+	return release, fits
+}
+
+// checkManifestDiskSpace checks the free disk space again with the sizes of the files listed in the archive manifest,
+// instead of the archive info or the estimate. If they fit, their space is reserved until the returned function is called.
+func (p puller) checkManifestDiskSpace(manifest archiveManifest) (func(), bool) {
+	log.Printf("Checking free disk space with the file sizes of the archive manifest")
+
+	freesReplaced := p.ext.journal == nil && !p.ext.opts.Staged
+	usages, err := filesystemUsages(manifestSizes(manifest, p.ext.targetPath, freesReplaced))
+	if err != nil {
+		log.Warnf("Failed to check free disk space: %s", err)
+		return func() {}, true
+	}
+
+	release, fits := reserveDiskSpace(usages)
+	logDiskUsages(usages)
+	return release, fits
+}
+
+func logDiskUsages(usages []filesystemUsage) {
+	for _, usage := range usages {
+		if !usage.fits() {
+			log.Warnf("Not enough disk space: %s", usage)
+		} else {
+			log.Printf("%s", usage)
+		}
+	}
+}
+
+// checkArchiveInfo runs the archive info based checks, it returns the portable paths to restore (nil for every path),
+// the paths not to restore, and whether the cache should be restored. Once the archive is extracted only the whole archive can be kept.
+func (p puller) checkArchiveInfo(archiveInfo []byte, extracted bool) (includeFilter, includeFilter, bool, error) {
+	conf := p.conf
+
+	if err := checkArchiveVersion(archiveInfo); err != nil {
+		log.Warnf("Cache archive is not compatible with this step: %s", err)
+		log.Warnf("Please update your cache-pull step to the latest version")
+		if !conf.DryRun {
+			log.Warnf("Skipping cache pull, as the archive was created by a newer cache-push step")
+			return nil, nil, false, nil
+		}
+		log.Warnf("The cache would be skipped, as the archive was created by a newer cache-push step")
+	}
+
+	// on a stack mismatch only the stack-agnostic paths are restored, if there are any
+	var portable includeFilter
+	sameStack := true
+	if p.stack.StackID != "" {
+		var err error
+		if sameStack, err = checkArchiveStack(conf, archiveInfo, p.stack, p.rules, p.archRules, p.name); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	if !sameStack {
+		if !extracted {
+			portable = portablePaths(archiveInfo, p.portable)
+		}
+		switch {
+		case len(portable) > 0 && !conf.DryRun:
+			log.Warnf("Restoring only the portable paths, as the stack has changed: %s", strings.Join(portable, ", "))
+			p.report.PortableOnly = true
+		case len(portable) > 0:
+			log.Warnf("Only the portable paths would be restored, as the stack has changed: %s", strings.Join(portable, ", "))
+		case !conf.DryRun:
+			log.Warnf("Skipping cache pull, as the stack has changed")
+			return nil, nil, false, nil
+		default:
+			log.Warnf("The cache would be skipped, as the stack has changed")
+		}
+	}
+
+	if !checkToolchain(archiveInfo, p.policies, p.toolchain, p.name) {
+		if !conf.DryRun {
+			log.Warnf("Skipping cache pull, as the toolchain has changed")
+			return nil, nil, false, nil
+		}
+		log.Warnf("The cache would be skipped, as the toolchain has changed")
+	}
+
+	var excluded includeFilter
+	if conf.LockfileCheck {
+		changed, paths, ok := checkLockfiles(archiveInfo, conf.WorkDir, p.name)
+		p.report.ChangedLockfiles = append(p.report.ChangedLockfiles, changed...)
+		switch {
+		case (!ok || extracted) && len(changed) > 0 && !conf.DryRun:
+			log.Warnf("Skipping cache pull, as the lockfiles have changed")
+			return nil, nil, false, nil
+		case len(changed) > 0 && !conf.DryRun:
+			log.Warnf("Not restoring the paths depending on the changed lockfiles: %s", strings.Join(paths, ", "))
+			excluded = paths
+		case !ok:
+			log.Warnf("The cache would be skipped, as the lockfiles have changed")
+		case len(changed) > 0:
+			log.Warnf("The paths depending on the changed lockfiles would not be restored: %s", strings.Join(paths, ", "))
+		}
+	}
+	return portable, excluded, true, nil
+}
+
+// fetchArchiveInfo downloads the sidecar archive info of the cache source, if there is one.
+func (p puller) fetchArchiveInfo(src cacheSource) []byte {
+	url := archiveInfoURL(src)
+	if p.conf.ArchiveInfoURL != "" && src.Layer == 0 {
+		url = p.conf.ArchiveInfoURL
+	}
+
+	archiveInfo, err := fetchArchiveInfo(url)
+	if err != nil {
+		log.Warnf("Failed to download archive info: %s", err)
+		return nil
+	}
+	if archiveInfo != nil {
+		log.Printf("Archive info found next to the archive")
+	}
+	return archiveInfo
+}
+
+// checkArchiveStack compares the archive's stack info (if the archive has an archive info) with the current stack.
+// It returns false if the cache should be skipped.
+func checkArchiveStack(conf Config, archiveInfo []byte, currentStackInfo model.ArchiveInfo, rules, archRules stackRules, name string) (bool, error) {
+	logSection(name, "Checking archive and current stacks")
+	log.Printf("current stack: %s", currentStackInfo)
+
+	if archiveInfo == nil {
+		log.Warnf("cache archive does not contain stack information, skipping stack check")
+		return true, nil
+	}
+
+	archiveStackInfo, err := parseArchiveInfo(archiveInfo)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse first archive entry: %s", err)
+	}
+	log.Printf("archive stack: %s", archiveStackInfo)
+
+	if !conf.IgnoreStackDifference && !isSameStack(archiveStackInfo, currentStackInfo, rules, archRules) {
+		log.Warnf("Cache was created on stack: %s, current stack: %s", archiveStackInfo, currentStackInfo)
+		return false, nil
+	}
+
+	if archiveStackInfo.Version < model.Version {
+		if archiveStackInfo.Architecture == "" {
+			log.Warnf("Cache has missing architecture info so default (amd64) architecture is assumed")
+		}
+
+		log.Warnf("Please update your cache-push step to the latest version")
+	}
+	return true, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const reportFileName = "cache-pull-report.json"
+
+// restoreConflict describes an archive entry whose target path already existed.
+type restoreConflict struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+}
+
+// restoreReport collects the details of a cache restore which are worth inspecting after the build.
+type restoreReport struct {
+	// Name is the name of a named cache, its report is saved in its own file.
+	Name               string             `json:"name,omitempty"`
+	Conflicts          []restoreConflict  `json:"conflicts,omitempty"`
+	ManifestMismatches []manifestMismatch `json:"manifest_mismatches,omitempty"`
+	SparseBytesSaved   int64              `json:"sparse_bytes_saved,omitempty"`
+	Whiteouts          []string           `json:"whiteouts,omitempty"`
+	Blocked            []string           `json:"blocked,omitempty"`
+	SignatureStatus    signatureStatus    `json:"signature_status,omitempty"`
+	PortableOnly       bool               `json:"portable_only,omitempty"`
+	Branch             string             `json:"branch,omitempty"`
+	ChangedLockfiles   []changedLockfile  `json:"changed_lockfiles,omitempty"`
+}
+
+func (r *restoreReport) addConflict(pth, action string) {
+	r.Conflicts = append(r.Conflicts, restoreConflict{Path: pth, Action: action})
+}
+
+// setSignatureStatus records an archive's signature verification result, keeping the worst one of the restored archives.
+func (r *restoreReport) setSignatureStatus(status signatureStatus) {
+	r.SignatureStatus = r.SignatureStatus.worse(status)
+}
+
+// notable reports whether the report has anything which needs attention: conflicts handled by a non-default policy,
+// manifest mismatches, blocked entries, changed lockfiles or a signature problem.
+func (r *restoreReport) notable() bool {
+	return len(r.Conflicts) > 0 || len(r.ManifestMismatches) > 0 || len(r.Blocked) > 0 || len(r.ChangedLockfiles) > 0 ||
+		r.SignatureStatus == signatureMissing || r.SignatureStatus == signatureInvalid
+}
+
+// write saves the report as JSON into the given directory and returns the report's path.
+func (r *restoreReport) write(dir string) (string, error) {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	fileName := reportFileName
+	if r.Name != "" {
+		fileName = strings.TrimSuffix(reportFileName, ".json") + "-" + r.Name + ".json"
+	}
+
+	pth := filepath.Join(dir, fileName)
+	if err := ioutil.WriteFile(pth, b, 0644); err != nil {
+		return "", err
+	}
+	return pth, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	// signatureSuffix is appended to the archive URL to get the signature's URL, if it is not specified.
+	signatureSuffix = ".sig"
+	// signatureStatusEnvKey is the step output holding the signature verification result.
+	signatureStatusEnvKey = "BITRISE_CACHE_SIGNATURE_STATUS"
+)
+
+// signatureStatus is the result of a cache archive's signature verification.
+type signatureStatus string
+
+const (
+	signatureNotChecked signatureStatus = "not-checked"
+	signatureVerified   signatureStatus = "verified"
+	signatureMissing    signatureStatus = "missing"
+	signatureInvalid    signatureStatus = "invalid"
+)
+
+// worse returns the status which is worse for the restored cache as a whole.
+func (s signatureStatus) worse(other signatureStatus) signatureStatus {
+	rank := map[signatureStatus]int{"": 0, signatureNotChecked: 1, signatureVerified: 2, signatureMissing: 3, signatureInvalid: 4}
+	if rank[other] > rank[s] {
+		return other
+	}
+	return s
+}
+
+var errSignatureNotFound = errors.New("signature not found")
+
+// parsePublicKey decodes an ed25519 public key given as hex or base64.
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == ed25519.PublicKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == ed25519.PublicKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("public key should be %d bytes, encoded as hex or base64", ed25519.PublicKeySize)
+}
+
+// signatureURL returns where the signature of the archive is, or an empty string if it cannot be derived.
+// Multi-part archives are signed as a whole, their signature replaces the part index in the pattern.
+func signatureURL(src cacheSource) string {
+	switch {
+	case src.Parts.pattern != "":
+		return strings.Replace(src.Parts.pattern, partPlaceholder, strings.TrimPrefix(signatureSuffix, "."), 1)
+	case !src.Parts.empty(), isBitriseCacheAPIURL(src.URL):
+		return ""
+	default:
+		return sidecarURL(src.URL, signatureSuffix)
+	}
+}
+
+// fetchSignature downloads an archive signature, stored either as the raw 64 bytes or base64 encoded.
+// It returns errSignatureNotFound if there is no signature at the given URL.
+func fetchSignature(url string) ([]byte, error) {
+	if url == "" {
+		return nil, errSignatureNotFound
+	}
+
+	body, err := openPart(url)
+	if err != nil {
+		if errors.Is(err, errPartNotFound) {
+			return nil, errSignatureNotFound
+		}
+		return nil, err
+	}
+	defer func() {
+		if err := body.Close(); err != nil {
+			log.Warnf("Failed to close signature: %s", err)
+		}
+	}()
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, 1024))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) == ed25519.SignatureSize {
+		return b, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("signature should be %d bytes, raw or base64 encoded", ed25519.SignatureSize)
+	}
+	return sig, nil
+}
+
+// verifyArchiveSignature checks the signature of the archive's SHA-256 digest.
+func verifyArchiveSignature(publicKey ed25519.PublicKey, digest, sig []byte) signatureStatus {
+	if sig == nil {
+		return signatureMissing
+	}
+	if !ed25519.Verify(publicKey, digest, sig) {
+		return signatureInvalid
+	}
+	return signatureVerified
+}
+
+// setSignatureStatus records the signature verification result as a step output.
+func (o *stepOutputs) setSignatureStatus(status signatureStatus, name string) {
+	o.set(outputKey(signatureStatusEnvKey, name), string(status))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveSignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	digest := sha256.Sum256([]byte("cache archive"))
+	sig := ed25519.Sign(privateKey, digest[:])
+
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "cache.tar.gz")
+	if err := ioutil.WriteFile(archive+signatureSuffix, []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0644); err != nil {
+		t.Fatalf("failed to write signature: %s", err)
+	}
+
+	fetched, err := fetchSignature(signatureURL(cacheSource{URL: "file://" + archive}))
+	if err != nil {
+		t.Fatalf("fetchSignature() error = %v", err)
+	}
+	if got := verifyArchiveSignature(publicKey, digest[:], fetched); got != signatureVerified {
+		t.Errorf("verifyArchiveSignature() = %s, want %s", got, signatureVerified)
+	}
+
+	tampered := sha256.Sum256([]byte("poisoned cache archive"))
+	if got := verifyArchiveSignature(publicKey, tampered[:], fetched); got != signatureInvalid {
+		t.Errorf("verifyArchiveSignature() of a modified archive = %s, want %s", got, signatureInvalid)
+	}
+
+	if _, err := fetchSignature("file://" + filepath.Join(dir, "other.tar.gz.sig")); err != errSignatureNotFound {
+		t.Errorf("fetchSignature() error = %v, want %v", err, errSignatureNotFound)
+	}
+	if got := verifyArchiveSignature(publicKey, digest[:], nil); got != signatureMissing {
+		t.Errorf("verifyArchiveSignature() without signature = %s, want %s", got, signatureMissing)
+	}
+}
+
+func Test_signatureStatus_worse(t *testing.T) {
+	status := signatureStatus("").worse(signatureVerified).worse(signatureInvalid).worse(signatureMissing)
+	if status != signatureInvalid {
+		t.Errorf("worse() = %s, want %s", status, signatureInvalid)
+	}
+}
+
+func Test_puller_downloadVerified(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	archive := []byte("cache archive")
+	digest := sha256.Sum256(archive)
+	sig := ed25519.Sign(privateKey, digest[:])
+
+	p := puller{conf: Config{SignatureVerification: "fail"}, publicKey: publicKey, report: &restoreReport{}}
+	f, temporary, err := p.downloadVerified(bytes.NewReader(archive), sig)
+	if err != nil {
+		t.Fatalf("downloadVerified() error = %v", err)
+	}
+	defer removeTempArchive(f)
+
+	if !temporary {
+		t.Errorf("downloadVerified() of a streamed archive should return a temporary file")
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("failed to read verified archive: %s", err)
+	}
+	if !bytes.Equal(got, archive) {
+		t.Errorf("verified archive = %q, want %q", got, archive)
+	}
+	if p.report.SignatureStatus != signatureVerified {
+		t.Errorf("signature status = %s, want %s", p.report.SignatureStatus, signatureVerified)
+	}
+}
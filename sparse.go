@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// sparseBlockSize is the granularity of the holes, matching the usual filesystem block size.
+	sparseBlockSize = 4096
+	// minPunchedHoleSize is the shortest zero run turned into a hole in regular (non sparse) files.
+	minPunchedHoleSize = 64 * 1024
+)
+
+var zeroBlock = make([]byte, sparseBlockSize)
+
+// isSparseEntry reports whether the entry is a GNU or PAX sparse file.
+func isSparseEntry(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// sparseWriter writes a file block by block, seeking over zero runs of at least minHole bytes
+// instead of writing them, so the filesystem stores them as holes.
+type sparseWriter struct {
+	f       *os.File
+	minHole int64
+
+	block   []byte
+	zeros   int64
+	offset  int64
+	skipped int64
+}
+
+func newSparseWriter(f *os.File, minHole int64) *sparseWriter {
+	return &sparseWriter{
+		f:       f,
+		minHole: minHole,
+		block:   make([]byte, 0, sparseBlockSize),
+	}
+}
+
+// Write implements the io.Writer interface.
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := copy(w.block[len(w.block):cap(w.block)], p)
+		w.block = w.block[:len(w.block)+m]
+		p = p[m:]
+
+		if len(w.block) == cap(w.block) {
+			if err := w.flushBlock(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *sparseWriter) flushBlock() error {
+	defer func() {
+		w.block = w.block[:0]
+	}()
+
+	if len(w.block) == sparseBlockSize && bytes.Equal(w.block, zeroBlock) {
+		w.zeros += sparseBlockSize
+		return nil
+	}
+
+	if err := w.flushZeros(); err != nil {
+		return err
+	}
+	_, err := w.f.Write(w.block)
+	w.offset += int64(len(w.block))
+	return err
+}
+
+// flushZeros seeks over the pending zero run if it is long enough, otherwise writes it.
+func (w *sparseWriter) flushZeros() error {
+	if w.zeros == 0 {
+		return nil
+	}
+
+	zeros := w.zeros
+	w.zeros = 0
+	w.offset += zeros
+
+	if zeros >= w.minHole {
+		w.skipped += zeros
+		_, err := w.f.Seek(zeros, io.SeekCurrent)
+		return err
+	}
+
+	for ; zeros > 0; zeros -= sparseBlockSize {
+		if _, err := w.f.Write(zeroBlock); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close writes the remaining data and extends the file to its full size if it ends with a hole.
+// It does not close the underlying file.
+func (w *sparseWriter) Close() error {
+	if len(w.block) > 0 {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+	}
+	if err := w.flushZeros(); err != nil {
+		return err
+	}
+	return w.f.Truncate(w.offset)
+}
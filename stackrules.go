@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// defaultStackRules are applied before the user defined rules.
+// Gen2 VMs have different stack IDs for the same stack types, depending on the machine.
+const defaultStackRules = `rewrite ^(.+)-gen2.*$ $1`
+
+// stackRuleKind is the first word of a stack rule line.
+type stackRuleKind string
+
+const (
+	// stackRewrite rewrites the stack IDs matching a regexp, e.g. to strip machine suffixes.
+	stackRewrite stackRuleKind = "rewrite"
+	// stackEquivalent lists stack ID patterns which are compatible with each other.
+	stackEquivalent stackRuleKind = "equivalent"
+	// stackAllow allows restoring the cache of the first stack ID pattern on the second one.
+	stackAllow stackRuleKind = "allow"
+	// stackDeny denies restoring the cache of the first stack ID pattern on the second one.
+	stackDeny stackRuleKind = "deny"
+)
+
+// stackRule is a parsed stack rule line. The patterns are glob patterns, except for rewrite's regexp.
+type stackRule struct {
+	kind        stackRuleKind
+	line        string
+	pattern     *regexp.Regexp
+	replacement string
+	stacks      []string
+}
+
+// stackRules decide which stack IDs are compatible, beyond being the same.
+// The architecture rules use the same format, for the archive and current architectures.
+type stackRules []stackRule
+
+// parseStackRules parses the newline separated rules, empty lines and lines starting with # are skipped.
+func parseStackRules(s string) (stackRules, error) {
+	var rules stackRules
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		rule := stackRule{kind: stackRuleKind(fields[0]), line: line}
+		args := fields[1:]
+		switch rule.kind {
+		case stackRewrite:
+			if len(args) != 2 {
+				return nil, fmt.Errorf("line %d: rewrite should have a regexp and a replacement: %s", i+1, line)
+			}
+			pattern, err := regexp.Compile(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid regexp: %s", i+1, err)
+			}
+			rule.pattern, rule.replacement = pattern, args[1]
+		case stackEquivalent:
+			if len(args) < 2 {
+				return nil, fmt.Errorf("line %d: equivalent should have at least two stacks: %s", i+1, line)
+			}
+			rule.stacks = args
+		case stackAllow, stackDeny:
+			if len(args) != 2 {
+				return nil, fmt.Errorf("line %d: %s should have an archive and a current stack: %s", i+1, rule.kind, line)
+			}
+			rule.stacks = args
+		default:
+			return nil, fmt.Errorf("line %d: unknown rule: %s", i+1, fields[0])
+		}
+
+		for _, pattern := range rule.stacks {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("line %d: invalid stack pattern %s: %s", i+1, pattern, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// loadStackRules returns the default rules, followed by the given rules and the rules of the given file, if any.
+func loadStackRules(rules, pth string) (stackRules, error) {
+	s := defaultStackRules + "\n" + rules
+	if pth != "" {
+		b, err := ioutil.ReadFile(pth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stack rules file: %s", err)
+		}
+		s += "\n" + string(b)
+	}
+	return parseStackRules(s)
+}
+
+// compatible reports whether the cache created on the archive stack can be restored on the current stack,
+// together with the rule deciding it, if any.
+// The rewrites are applied first, in order, then the deny, allow and equivalent rules are checked on the rewritten IDs.
+func (rules stackRules) compatible(archiveStack, currentStack string) (bool, string) {
+	for _, rule := range rules {
+		if rule.kind == stackRewrite {
+			archiveStack = rule.pattern.ReplaceAllString(archiveStack, rule.replacement)
+			currentStack = rule.pattern.ReplaceAllString(currentStack, rule.replacement)
+		}
+	}
+
+	for _, kind := range []stackRuleKind{stackDeny, stackAllow} {
+		for _, rule := range rules {
+			if rule.kind == kind && matchStack(rule.stacks[0], archiveStack) && matchStack(rule.stacks[1], currentStack) {
+				return kind == stackAllow, rule.line
+			}
+		}
+	}
+
+	if archiveStack == currentStack {
+		return true, ""
+	}
+
+	for _, rule := range rules {
+		if rule.kind == stackEquivalent && matchAnyStack(rule.stacks, archiveStack) && matchAnyStack(rule.stacks, currentStack) {
+			return true, rule.line
+		}
+	}
+	return false, ""
+}
+
+func matchStack(pattern, stack string) bool {
+	ok, err := path.Match(pattern, stack)
+	return err == nil && ok
+}
+
+func matchAnyStack(patterns []string, stack string) bool {
+	for _, pattern := range patterns {
+		if matchStack(pattern, stack) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func Test_stackRules_compatible(t *testing.T) {
+	rules, err := loadStackRules(`
+# Docker and VM stacks of the same Ubuntu version
+equivalent linux-docker-android-22.04 ubuntu-jammy-22.04-bitrise-*
+allow osx-xcode-15.0.x osx-xcode-15.1.x
+deny osx-xcode-14.* osx-xcode-14.3.x-edge
+`, "")
+	if err != nil {
+		t.Fatalf("loadStackRules() error = %v", err)
+	}
+
+	tests := []struct {
+		archiveStack string
+		currentStack string
+		want         bool
+		wantRule     string
+	}{
+		{archiveStack: "osx-xcode-15.0.x", currentStack: "osx-xcode-15.0.x", want: true},
+		{archiveStack: "osx-xcode-15.0.x-gen2-mmg4-4c", currentStack: "osx-xcode-15.0.x", want: true},
+		{archiveStack: "linux-docker-android-22.04", currentStack: "ubuntu-jammy-22.04-bitrise-2024", want: true, wantRule: "equivalent linux-docker-android-22.04 ubuntu-jammy-22.04-bitrise-*"},
+		{archiveStack: "ubuntu-jammy-22.04-bitrise-2024", currentStack: "linux-docker-android-22.04", want: true, wantRule: "equivalent linux-docker-android-22.04 ubuntu-jammy-22.04-bitrise-*"},
+		{archiveStack: "osx-xcode-15.0.x-gen2-mmg4-4c", currentStack: "osx-xcode-15.1.x", want: true, wantRule: "allow osx-xcode-15.0.x osx-xcode-15.1.x"},
+		{archiveStack: "osx-xcode-15.1.x", currentStack: "osx-xcode-15.0.x", want: false},
+		{archiveStack: "osx-xcode-14.3.x-edge", currentStack: "osx-xcode-14.3.x-edge", want: false, wantRule: "deny osx-xcode-14.* osx-xcode-14.3.x-edge"},
+	}
+	for _, tt := range tests {
+		got, rule := rules.compatible(tt.archiveStack, tt.currentStack)
+		if got != tt.want || rule != tt.wantRule {
+			t.Errorf("compatible(%s, %s) = %v, %q, want %v, %q", tt.archiveStack, tt.currentStack, got, rule, tt.want, tt.wantRule)
+		}
+	}
+
+	for _, invalid := range []string{"rewrite ^(a", "allow only-one", "equivalent a", "prefer a b"} {
+		if _, err := parseStackRules(invalid); err == nil {
+			t.Errorf("parseStackRules(%s) expected error", invalid)
+		}
+	}
+}
+
+func Test_architectureRules(t *testing.T) {
+	rules, err := parseStackRules("allow amd64 arm64")
+	if err != nil {
+		t.Fatalf("parseStackRules() error = %v", err)
+	}
+	if ok, _ := rules.compatible("amd64", "arm64"); !ok {
+		t.Errorf("compatible(amd64, arm64) = false, want true")
+	}
+	if ok, _ := rules.compatible("arm64", "amd64"); ok {
+		t.Errorf("compatible(arm64, amd64) = true, want false")
+	}
+}
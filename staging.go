@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	stagingDirPrefix = ".cache-pull-staging-"
+	// backupSuffix is appended to the staging path of a file to get the backup path of the file it replaces.
+	backupSuffix = ".backup"
+)
+
+// stagedEntry is an extracted entry waiting to be moved to its final location.
+type stagedEntry struct {
+	target   string
+	staged   string
+	dir      bool
+	whiteout bool
+}
+
+// stagingArea keeps extracted entries on the same filesystem as their final location,
+// so they can be moved into place with renames once the whole archive is extracted.
+type stagingArea struct {
+	roots   map[uint64]string
+	entries []stagedEntry
+	paths   map[string]string
+}
+
+func newStagingArea() *stagingArea {
+	return &stagingArea{
+		roots: map[uint64]string{},
+		paths: map[string]string{},
+	}
+}
+
+// path returns a new staging path for the given target, creating a staging dir on the target's filesystem if needed.
+func (s *stagingArea) path(target string) (string, error) {
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+
+	ancestor, dev, err := existingAncestor(filepath.Dir(abs))
+	if err != nil {
+		return "", err
+	}
+
+	root, ok := s.roots[dev]
+	if !ok {
+		root, err = createStagingRoot(ancestor, dev)
+		if err != nil {
+			return "", fmt.Errorf("failed to create staging dir for %s: %s", target, err)
+		}
+		log.Debugf("Staging dir: %s", root)
+		s.roots[dev] = root
+	}
+
+	return filepath.Join(root, strconv.Itoa(len(s.entries))), nil
+}
+
+// addFile records a file, symlink or hard link written to its staging path.
+func (s *stagingArea) addFile(target, staged string) {
+	s.entries = append(s.entries, stagedEntry{target: target, staged: staged})
+	s.paths[target] = staged
+}
+
+// addDir records a directory to be created at commit, its permissions are set by the extractor afterwards.
+func (s *stagingArea) addDir(target string) {
+	s.entries = append(s.entries, stagedEntry{target: target, dir: true})
+}
+
+// addWhiteout records a path to be removed at commit.
+func (s *stagingArea) addWhiteout(target string) {
+	s.entries = append(s.entries, stagedEntry{target: target, whiteout: true})
+}
+
+// stagedPath returns where the given target is staged, or the target itself if it was not staged.
+func (s *stagingArea) stagedPath(target string) string {
+	if staged, ok := s.paths[target]; ok {
+		return staged
+	}
+	return target
+}
+
+// commit moves the staged entries to their final location in archive order and returns the committed entries.
+// The changes are recorded in the given journal, which takes over the staging dirs, as they hold the backups of the replaced files.
+func (s *stagingArea) commit(j *journal) ([]stagedEntry, error) {
+	defer func() {
+		for _, root := range s.roots {
+			j.adoptDir(root)
+		}
+		s.roots = map[uint64]string{}
+	}()
+
+	var committed []stagedEntry
+	for _, entry := range s.entries {
+		done := j.begin()
+		err := s.commitEntry(j, entry)
+		done()
+		if err != nil {
+			return committed, err
+		}
+		committed = append(committed, entry)
+	}
+	return committed, nil
+}
+
+// commitEntry moves a staged entry to its final location.
+func (s *stagingArea) commitEntry(j *journal, entry stagedEntry) error {
+	if entry.whiteout {
+		abs, err := filepath.Abs(entry.target)
+		if err != nil {
+			return err
+		}
+		for _, root := range s.roots {
+			if root == abs || strings.HasPrefix(root, abs+string(filepath.Separator)) {
+				return fmt.Errorf("whiteout of %s would remove the staging dir %s", entry.target, root)
+			}
+		}
+		if err := j.remove(entry.target); err != nil {
+			return fmt.Errorf("failed to remove %s: %s", entry.target, err)
+		}
+		return nil
+	}
+
+	if entry.dir {
+		if err := j.record(entry.target); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(entry.target, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %s", entry.target, err)
+		}
+		return nil
+	}
+
+	if err := j.replace(entry.target, entry.staged+backupSuffix); err != nil {
+		return err
+	}
+	// the rename replaces an existing file atomically
+	if err := prepareParent(entry.target); err != nil {
+		return fmt.Errorf("failed to prepare %s: %s", entry.target, err)
+	}
+	if err := os.Rename(entry.staged, entry.target); err != nil {
+		return fmt.Errorf("failed to move %s into place: %s", entry.target, err)
+	}
+	return nil
+}
+
+// cleanup removes the staging dirs with everything left in them.
+func (s *stagingArea) cleanup() {
+	for _, root := range s.roots {
+		if err := os.RemoveAll(root); err != nil {
+			log.Warnf("Failed to remove staging dir %s: %s", root, err)
+		}
+	}
+	s.roots = map[uint64]string{}
+}
+
+// createStagingRoot creates a staging dir on the device dev, ancestor being an existing directory on it.
+// The staging dir is created in the temp dir if it is on the same device, otherwise in the topmost writable directory
+// of the device (e.g. the home directory), to stay out of the restored trees, which the archive's whiteouts can remove.
+func createStagingRoot(ancestor string, dev uint64) (string, error) {
+	if tmp, tmpDev, err := existingAncestor(os.TempDir()); err == nil && tmpDev == dev {
+		if root, err := ioutil.TempDir(tmp, stagingDirPrefix); err == nil {
+			return root, nil
+		}
+	}
+
+	candidates := []string{ancestor}
+	for dir := filepath.Dir(ancestor); dir != candidates[len(candidates)-1]; dir = filepath.Dir(dir) {
+		if _, parentDev, err := existingAncestor(dir); err != nil || parentDev != dev {
+			break
+		}
+		candidates = append(candidates, dir)
+	}
+
+	var err error
+	for i := len(candidates) - 1; i >= 0; i-- {
+		var root string
+		if root, err = ioutil.TempDir(candidates[i], stagingDirPrefix); err == nil {
+			return root, nil
+		}
+	}
+	return "", err
+}
+
+// existingAncestor returns the closest existing directory to pth (including itself) and its device id.
+func existingAncestor(pth string) (string, uint64, error) {
+	for {
+		info, err := os.Stat(pth)
+		if err == nil {
+			st, ok := info.Sys().(*syscall.Stat_t)
+			if !ok {
+				return "", 0, fmt.Errorf("failed to get device of %s", pth)
+			}
+			return pth, uint64(st.Dev), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", 0, err
+		}
+
+		parent := filepath.Dir(pth)
+		if parent == pth {
+			return "", 0, err
+		}
+		pth = parent
+	}
+}
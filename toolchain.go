@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// toolchainPolicy tells what to do if a toolchain field of the archive differs from the current machine's.
+type toolchainPolicy string
+
+const (
+	toolchainMatch  toolchainPolicy = "match"
+	toolchainWarn   toolchainPolicy = "warn"
+	toolchainIgnore toolchainPolicy = "ignore"
+)
+
+// defaultToolchainField is the policy key applying to the fields without their own policy.
+const defaultToolchainField = "*"
+
+// toolchainInfo is the toolchain information the cache push step can store in the archive info.
+type toolchainInfo struct {
+	OSVersion string `json:"os_version,omitempty"`
+	Xcode     string `json:"xcode,omitempty"`
+	JDK       string `json:"jdk,omitempty"`
+	Node      string `json:"node,omitempty"`
+	Ruby      string `json:"ruby,omitempty"`
+	// Fingerprints are arbitrary user defined values, e.g. the hash of a lockfile or a tool's version.
+	Fingerprints map[string]string `json:"fingerprints,omitempty"`
+}
+
+// fields returns the non-empty toolchain fields by name, the fingerprints are named as they are.
+func (t toolchainInfo) fields() map[string]string {
+	fields := map[string]string{}
+	for name, value := range t.Fingerprints {
+		fields[name] = value
+	}
+	for name, value := range map[string]string{"os_version": t.OSVersion, "xcode": t.Xcode, "jdk": t.JDK, "node": t.Node, "ruby": t.Ruby} {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+	return fields
+}
+
+// toolchainPolicies are the policies by toolchain field name.
+type toolchainPolicies map[string]toolchainPolicy
+
+// parseToolchainPolicies parses newline separated field=policy lines.
+func parseToolchainPolicies(s string) (toolchainPolicies, error) {
+	policies := toolchainPolicies{}
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		field, value := splitKeyValue(line)
+		switch policy := toolchainPolicy(value); policy {
+		case toolchainMatch, toolchainWarn, toolchainIgnore:
+			policies[field] = policy
+		default:
+			return nil, fmt.Errorf("invalid policy for %s: %s, should be one of match, warn or ignore", field, value)
+		}
+	}
+	return policies, nil
+}
+
+// policy returns the field's policy, the default one if the field has no policy, or warn if neither is specified.
+func (p toolchainPolicies) policy(field string) toolchainPolicy {
+	if policy, ok := p[field]; ok {
+		return policy
+	}
+	if policy, ok := p[defaultToolchainField]; ok {
+		return policy
+	}
+	return toolchainWarn
+}
+
+// parseFingerprints parses newline separated name=value lines.
+func parseFingerprints(s string) map[string]string {
+	fingerprints := map[string]string{}
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		name, value := splitKeyValue(line)
+		fingerprints[name] = value
+	}
+	return fingerprints
+}
+
+func splitKeyValue(line string) (string, string) {
+	split := strings.SplitN(line, "=", 2)
+	if len(split) == 1 {
+		return strings.TrimSpace(split[0]), ""
+	}
+	return strings.TrimSpace(split[0]), strings.TrimSpace(split[1])
+}
+
+// currentToolchain detects the toolchain of the current machine lazily, only the fields the archives have.
+type currentToolchain struct {
+	fingerprints map[string]string
+	detected     map[string]string
+	detect       func(field string) string
+}
+
+func newCurrentToolchain(fingerprints map[string]string) *currentToolchain {
+	return &currentToolchain{
+		fingerprints: fingerprints,
+		detected:     map[string]string{},
+		detect:       detectToolchainField,
+	}
+}
+
+// value returns the current value of a toolchain field, or an empty string if it is not installed or unknown.
+func (c *currentToolchain) value(field string) string {
+	if value, ok := c.fingerprints[field]; ok {
+		return value
+	}
+	if value, ok := c.detected[field]; ok {
+		return value
+	}
+
+	value := c.detect(field)
+	c.detected[field] = value
+	return value
+}
+
+// checkToolchain compares the archive's toolchain with the current one, and reports whether the archive can be restored:
+// it can not be if a field with the match policy differs.
+func checkToolchain(archiveInfo []byte, policies toolchainPolicies, current *currentToolchain, cacheName string) bool {
+	if archiveInfo == nil {
+		return true
+	}
+
+	var info toolchainInfo
+	if err := json.Unmarshal(archiveInfo, &info); err != nil {
+		log.Debugf("Failed to parse archive toolchain info: %s", err)
+		return true
+	}
+
+	fields := info.fields()
+	if len(fields) == 0 {
+		return true
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	logSection(cacheName, "Checking archive and current toolchains")
+
+	ok := true
+	for _, name := range names {
+		policy := policies.policy(name)
+		if policy == toolchainIgnore {
+			continue
+		}
+
+		archiveValue, currentValue := fields[name], current.value(name)
+		if archiveValue == currentValue {
+			log.Printf("%s: %s", name, archiveValue)
+			continue
+		}
+
+		if currentValue == "" {
+			currentValue = "unknown"
+		}
+		if policy == toolchainMatch {
+			log.Warnf("%s: cache was created with %s, current: %s", name, archiveValue, currentValue)
+			ok = false
+		} else {
+			log.Warnf("%s: cache was created with %s, current: %s, restoring anyway", name, archiveValue, currentValue)
+		}
+	}
+	return ok
+}
+
+// detectToolchainField returns the current machine's value of a built-in toolchain field.
+func detectToolchainField(field string) string {
+	switch field {
+	case "os_version":
+		if runtime.GOOS == "darwin" {
+			return commandOutput("sw_vers", "-productVersion")
+		}
+		b, err := ioutil.ReadFile("/etc/os-release")
+		if err != nil {
+			return ""
+		}
+		return osReleaseVersion(string(b))
+	case "xcode":
+		return xcodeVersion(commandOutput("xcodebuild", "-version"))
+	case "jdk":
+		return javaVersion(commandOutput("java", "-version"))
+	case "node":
+		return strings.TrimPrefix(commandOutput("node", "--version"), "v")
+	case "ruby":
+		return commandOutput("ruby", "-e", "print RUBY_VERSION")
+	default:
+		return ""
+	}
+}
+
+// commandOutput runs the command and returns its output, or an empty string if it fails (e.g. it is not installed).
+func commandOutput(name string, args ...string) string {
+	out, err := command.New(name, args...).RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		log.Debugf("Failed to run %s: %s", name, err)
+		return ""
+	}
+	return out
+}
+
+// osReleaseVersion returns the VERSION_ID of an /etc/os-release file.
+func osReleaseVersion(osRelease string) string {
+	for _, line := range strings.Split(osRelease, "\n") {
+		if strings.HasPrefix(line, "VERSION_ID=") {
+			return strings.Trim(strings.TrimPrefix(line, "VERSION_ID="), `"`)
+		}
+	}
+	return ""
+}
+
+// xcodeVersion returns the version from the output of xcodebuild -version, e.g. 15.2 from "Xcode 15.2\nBuild version 15C500b".
+func xcodeVersion(out string) string {
+	line := strings.SplitN(out, "\n", 2)[0]
+	if !strings.HasPrefix(line, "Xcode ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, "Xcode "))
+}
+
+var javaVersionPattern = regexp.MustCompile(`version "([^"]+)"`)
+
+// javaVersion returns the version from the output of java -version, e.g. 17.0.2 from `openjdk version "17.0.2" 2022-01-18`.
+func javaVersion(out string) string {
+	match := javaVersionPattern.FindStringSubmatch(out)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
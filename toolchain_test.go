@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func Test_checkToolchain(t *testing.T) {
+	archiveInfo := []byte(`{"stack_id": "osx-xcode-15.0.x", "xcode": "15.0", "node": "18.1.0", "fingerprints": {"flutter": "3.16.0"}}`)
+
+	tests := []struct {
+		name     string
+		policies string
+		current  map[string]string
+		want     bool
+	}{
+		{name: "same toolchain", policies: "xcode=match", current: map[string]string{"xcode": "15.0", "node": "18.1.0", "flutter": "3.16.0"}, want: true},
+		{name: "warn by default", current: map[string]string{"xcode": "15.2"}, want: true},
+		{name: "must match", policies: "xcode=match", current: map[string]string{"xcode": "15.2", "node": "18.1.0"}, want: false},
+		{name: "default policy", policies: "*=match\nnode=ignore", current: map[string]string{"xcode": "15.0", "flutter": "3.16.0"}, want: true},
+		{name: "unknown fingerprint", policies: "flutter=match", current: map[string]string{}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policies, err := parseToolchainPolicies(tt.policies)
+			if err != nil {
+				t.Fatalf("parseToolchainPolicies() error = %v", err)
+			}
+			current := newCurrentToolchain(map[string]string{})
+			current.detect = func(field string) string { return tt.current[field] }
+
+			if got := checkToolchain(archiveInfo, policies, current, ""); got != tt.want {
+				t.Errorf("checkToolchain() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseToolchainPolicies("xcode=strict"); err == nil {
+		t.Errorf("parseToolchainPolicies() expected error for an invalid policy")
+	}
+}
+
+func Test_toolchainVersions(t *testing.T) {
+	if got := xcodeVersion("Xcode 15.2\nBuild version 15C500b"); got != "15.2" {
+		t.Errorf("xcodeVersion() = %s, want 15.2", got)
+	}
+	if got := javaVersion("openjdk version \"17.0.2\" 2022-01-18\nOpenJDK Runtime Environment"); got != "17.0.2" {
+		t.Errorf("javaVersion() = %s, want 17.0.2", got)
+	}
+	if got := osReleaseVersion("NAME=\"Ubuntu\"\nVERSION_ID=\"22.04\"\n"); got != "22.04" {
+		t.Errorf("osReleaseVersion() = %s, want 22.04", got)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// whiteoutPrefix marks an entry of a cache layer which deletes the path of the same name without the prefix.
+	whiteoutPrefix = ".wh."
+	// opaqueWhiteout is the OCI marker hiding a whole directory's lower layer contents, which is not supported.
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// whiteoutTarget returns the path deleted by a whiteout entry, or false if the entry is not a whiteout.
+func whiteoutTarget(target string) (string, bool) {
+	name := filepath.Base(target)
+	if !strings.HasPrefix(name, whiteoutPrefix) || name == opaqueWhiteout {
+		return "", false
+	}
+	return filepath.Join(filepath.Dir(target), strings.TrimPrefix(name, whiteoutPrefix)), true
+}
+
+// whiteoutName returns the archive entry name of the path deleted by a whiteout entry.
+func whiteoutName(name string) string {
+	dir, base := path.Split(name)
+	return dir + strings.TrimPrefix(base, whiteoutPrefix)
+}